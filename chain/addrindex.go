@@ -0,0 +1,114 @@
+package chain
+
+import (
+	"slices"
+
+	"github.com/glossd/viatcoin/chain/util"
+)
+
+// The address index lists the confirmed transactions of every address.
+// It's optional because it takes memory proportional to the whole history, see EnableAddressIndex.
+
+type Direction string
+
+const (
+	// the address received coins in the transaction
+	DirectionIn Direction = "in"
+	// the address sent coins in the transaction, the amount includes the fee
+	DirectionOut Direction = "out"
+)
+
+type AddressTx struct {
+	Height    int
+	TxID      string
+	Direction Direction
+	Amount    Coin
+}
+
+var addressIndexEnabled bool
+
+// entries of an address are in the blockchain order
+var addressIndex = util.Map[string, []AddressTx]{}
+
+// EnableAddressIndex must be called before Run, the index is built while the blockchain is loaded.
+func EnableAddressIndex() {
+	addressIndexEnabled = true
+}
+
+// indexAddresses adds the transactions of the block at the height.
+func indexAddresses(height int, ts []Transaction) {
+	if !addressIndexEnabled {
+		return
+	}
+	for i, t := range ts {
+		id := t.ID()
+		received := make(map[string]Coin)
+		var order []string
+		sent := t.Fee
+		for _, tf := range t.Transfers {
+			if _, ok := received[tf.To]; !ok {
+				order = append(order, tf.To)
+			}
+			received[tf.To] += tf.Amount
+			sent += tf.Amount
+		}
+		// the coinbase mints coins, nothing leaves its sender.
+		if i > 0 {
+			addAddressTx(t.From, AddressTx{Height: height, TxID: id, Direction: DirectionOut, Amount: sent})
+		}
+		for _, addr := range order {
+			addAddressTx(addr, AddressTx{Height: height, TxID: id, Direction: DirectionIn, Amount: received[addr]})
+		}
+	}
+}
+
+func addAddressTx(addr string, e AddressTx) {
+	entries, _ := addressIndex.Load(addr)
+	addressIndex.Store(addr, append(entries, e))
+}
+
+// unindexAddresses removes the transactions of the disconnected tip block.
+func unindexAddresses(ts []Transaction) {
+	if !addressIndexEnabled {
+		return
+	}
+	ids := make(map[string]bool, len(ts))
+	for _, t := range ts {
+		ids[t.ID()] = true
+	}
+	for _, t := range ts {
+		addrs := []string{t.From}
+		for _, tf := range t.Transfers {
+			addrs = append(addrs, tf.To)
+		}
+		for _, addr := range addrs {
+			entries, ok := addressIndex.Load(addr)
+			if !ok {
+				continue
+			}
+			n := len(entries)
+			for n > 0 && ids[entries[n-1].TxID] {
+				n--
+			}
+			if n == 0 {
+				addressIndex.Delete(addr)
+			} else {
+				// capped, so that the next append doesn't overwrite what a reader may still see.
+				addressIndex.Store(addr, entries[:n:n])
+			}
+		}
+	}
+}
+
+// AddressTxs returns the confirmed transactions of the address, the latest first.
+func AddressTxs(addr string, skip, limit int) []AddressTx {
+	entries, _ := addressIndex.Load(addr)
+	j := len(entries) - max(skip, 0)
+	i := max(j-limit, 0)
+	if j <= 0 || limit <= 0 {
+		return []AddressTx{}
+	}
+	res := slices.Clone(entries[i:j])
+	slices.Reverse(res)
+	return res
+}
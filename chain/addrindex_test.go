@@ -0,0 +1,65 @@
+package chain
+
+import (
+	"testing"
+)
+
+func enableAddressIndex(t *testing.T) {
+	EnableAddressIndex()
+	t.Cleanup(func() { addressIndexEnabled = false })
+}
+
+func TestAddressIndex(t *testing.T) {
+	resetBlockchain(t)
+	enableAddressIndex(t)
+	alice := mustPrivKey()
+	aliceAddr := alice.PublicKey().Address(network)
+	bob := mustPrivKey().PublicKey().Address(network)
+
+	b1 := mineEasyBlockPaying(t, genesisBlock, aliceAddr)
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	tx := NewTransaction([]Transfer{{To: bob, Amount: 10}, {To: bob, Amount: 5}})
+	tx.Fee = 1
+	tx, err := tx.Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2 := mineEasyBlock(t, b1, tx)
+	if err := Broadcast(a2); err != nil {
+		t.Fatal(err)
+	}
+
+	got := AddressTxs(aliceAddr, 0, 20)
+	expected := []AddressTx{
+		{Height: 2, TxID: tx.ID(), Direction: DirectionOut, Amount: 16},
+		{Height: 1, TxID: b1.Transactions[0].ID(), Direction: DirectionIn, Amount: GetMinerReward()},
+	}
+	if len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] {
+		t.Fatalf("unexpected alice's transactions: %+v", got)
+	}
+	// transfers to the same address are summed up
+	if got := AddressTxs(bob, 0, 20); len(got) != 1 || got[0].Amount != 15 || got[0].Direction != DirectionIn {
+		t.Errorf("unexpected bob's transactions: %+v", got)
+	}
+	if got := AddressTxs(aliceAddr, 1, 1); len(got) != 1 || got[0] != expected[1] {
+		t.Errorf("unexpected page: %+v", got)
+	}
+	if got := AddressTxs(aliceAddr, 2, 20); len(got) != 0 {
+		t.Errorf("expected empty page: %+v", got)
+	}
+
+	// the branch without alice's transaction rolls the index back
+	c2 := mineEasyBlock(t, b1)
+	c3 := mineEasyBlock(t, c2)
+	if err := reorganize([]Block{c2, c3}); err != nil {
+		t.Fatal(err)
+	}
+	if got := AddressTxs(bob, 0, 20); len(got) != 0 {
+		t.Errorf("bob's orphaned transaction must be removed: %+v", got)
+	}
+	if got := AddressTxs(aliceAddr, 0, 20); len(got) != 1 || got[0] != expected[1] {
+		t.Errorf("only alice's coinbase must stay: %+v", got)
+	}
+}
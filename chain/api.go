@@ -1,22 +1,51 @@
 package chain
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/glossd/fetch"
 )
 
 func Run(port int, joinNetworkUrls ...string) {
-	err := Join(joinNetworkUrls)
+	apiPort = port
+	err := checkGenesis()
+	if err != nil {
+		log.Fatalf("Refusing to start: %s", err)
+	}
+
+	err = loadBlockchain()
+	if err != nil {
+		log.Fatalf("Failed to load blockchain: %s", err)
+	}
+
+	err = Join(joinNetworkUrls)
 	if err != nil {
 		log.Fatalf("Failed to join network: %s", err)
 	}
 
+	http.ListenAndServe(fmt.Sprintf(":%d", port), APIHandler())
+}
+
+type AddressBalance struct {
+	// the balance with all the blocks, i.e. at least one confirmation
+	Confirmed Coin
+	// the confirmations query parameter, 6 by default
+	Confirmations   int
+	AtConfirmations Coin
+	// transactions of the mempool, the outgoing amount includes the fees
+	PendingIncoming Coin
+	PendingOutgoing Coin
+}
+
+// APIHandler serves the node's API, Run listens with it.
+func APIHandler() http.Handler {
 	sm := &http.ServeMux{}
 
 	sm.HandleFunc("GET /api/blocks", fetch.ToHandlerFunc(func(in fetch.RequestEmpty) ([]Block, error) {
@@ -25,14 +54,18 @@ func Run(port int, joinNetworkUrls ...string) {
 		if err != nil {
 			limit = 20
 		}
+		n := blockchain.Len()
 		if limit == -1 {
-			limit = math.MaxInt
+			limit = n
 		}
 		skip, _ := strconv.Atoi(in.Parameters["skip"])
+		// the chain may have shrunk since the caller got its height, out of range gives no blocks
+		limit = min(max(limit, 0), n)
+		skip = min(max(skip, 0), n)
 
 		if sort == "asc" {
-			j := skip
-			i := j + limit
+			i := skip
+			j := i + limit
 			return blockchain.LoadRangeSafe(i, j), nil
 		} else {
 			// descending
@@ -61,6 +94,18 @@ func Run(port int, joinNetworkUrls ...string) {
 		return Block{}, &fetch.Error{Status: 404, Msg: "block not found"}
 	}))
 
+	sm.HandleFunc("GET /api/headers", fetch.ToHandlerFunc(func(in fetch.RequestEmpty) ([][]byte, error) {
+		var locator []string
+		if l := in.Parameters["locator"]; l != "" {
+			locator = strings.Split(l, ",")
+		}
+		limit, err := strconv.Atoi(in.Parameters["limit"])
+		if err != nil || limit <= 0 || limit > MaxHeadersPerRequest {
+			limit = MaxHeadersPerRequest
+		}
+		return headersAfter(locator, limit), nil
+	}))
+
 	sm.HandleFunc("GET /api/blocks/last", fetch.ToHandlerFuncEmptyIn(func() (Block, error) {
 		return blockchain.Last(), nil
 	}))
@@ -69,6 +114,22 @@ func Run(port int, joinNetworkUrls ...string) {
 		return Broadcast(in)
 	}))
 
+	sm.HandleFunc("GET /api/mining/template", fetch.ToHandlerFuncEmptyIn(func() (BlockTemplate, error) {
+		return NewBlockTemplate()
+	}))
+
+	// responds with the block hash, or 409 Conflict if another block was found first
+	sm.HandleFunc("POST /api/mining/submit", fetch.ToHandlerFunc(func(in fetch.Request[BlockSubmission]) (string, error) {
+		err := SubmitBlock(in.Body)
+		if errors.Is(err, ErrStaleTemplate) || errors.Is(err, ErrStaleTip) {
+			return "", &fetch.Error{Status: 409, Msg: err.Error()}
+		}
+		if err != nil {
+			return "", err
+		}
+		return in.Body.Block.HashString(), nil
+	}))
+
 	sm.HandleFunc("GET /api/mempool", fetch.ToHandlerFunc(func(in fetch.Request[fetch.Empty]) ([]Transaction, error) {
 		limit, err := strconv.Atoi(in.Parameters["limit"])
 		if err != nil {
@@ -81,8 +142,71 @@ func Run(port int, joinNetworkUrls ...string) {
 		return Top(limit), nil
 	}))
 
-	sm.HandleFunc("POST /api/mempool", fetch.ToHandlerFuncEmptyOut(func(in Transaction) error {
-		return Push(in)
+	// responds with the txid
+	sm.HandleFunc("POST /api/mempool", fetch.ToHandlerFunc(func(in fetch.Request[Transaction]) (string, error) {
+		if err := Push(in.Body); err != nil {
+			return "", err
+		}
+		return in.Body.ID(), nil
+	}))
+
+	sm.HandleFunc("GET /api/mempool/{id}", fetch.ToHandlerFunc(func(in fetch.RequestEmpty) (Transaction, error) {
+		t, ok := Get(in.PathValues["id"])
+		if !ok {
+			return Transaction{}, &fetch.Error{Status: 404, Msg: "transaction not found"}
+		}
+		return t, nil
+	}))
+
+	sm.HandleFunc("GET /api/tx/{id}", fetch.ToHandlerFunc(func(in fetch.RequestEmpty) (TxStatus, error) {
+		s, ok := FindTransaction(in.PathValues["id"])
+		if !ok {
+			return TxStatus{}, &fetch.Error{Status: 404, Msg: "transaction not found"}
+		}
+		return s, nil
+	}))
+
+	sm.HandleFunc("GET /api/tx/{id}/proof", fetch.ToHandlerFunc(func(in fetch.RequestEmpty) (MerkleProof, error) {
+		p, ok := ProveTransaction(in.PathValues["id"])
+		if !ok {
+			return MerkleProof{}, &fetch.Error{Status: 404, Msg: "confirmed transaction not found"}
+		}
+		return p, nil
+	}))
+
+	sm.HandleFunc("GET /api/address/{addr}/txs", fetch.ToHandlerFunc(func(in fetch.RequestEmpty) ([]AddressTx, error) {
+		if !addressIndexEnabled {
+			return nil, &fetch.Error{Status: 501, Msg: "address index isn't enabled on this node"}
+		}
+		limit, err := strconv.Atoi(in.Parameters["limit"])
+		if err != nil {
+			limit = 20
+		}
+		if limit == -1 {
+			limit = math.MaxInt
+		}
+		skip, _ := strconv.Atoi(in.Parameters["skip"])
+		return AddressTxs(in.PathValues["addr"], skip, limit), nil
+	}))
+
+	sm.HandleFunc("GET /api/address/{addr}/balance", fetch.ToHandlerFunc(func(in fetch.RequestEmpty) (AddressBalance, error) {
+		addr := in.PathValues["addr"]
+		confirmations, err := strconv.Atoi(in.Parameters["confirmations"])
+		if err != nil || confirmations < 1 {
+			confirmations = 6
+		}
+		res := AddressBalance{
+			Confirmed:       Balance(addr),
+			Confirmations:   confirmations,
+			AtConfirmations: ConfirmedBalance(addr, confirmations),
+		}
+		res.PendingIncoming, res.PendingOutgoing = PendingAmounts(addr)
+		return res, nil
+	}))
+
+	// the mempool transactions of the address are counted
+	sm.HandleFunc("GET /api/address/{addr}/nonce", fetch.ToHandlerFunc(func(in fetch.RequestEmpty) (uint64, error) {
+		return PendingNextNonce(in.PathValues["addr"]), nil
 	}))
 
 	sm.HandleFunc("GET /api/difficulty/target/bits", fetch.ToHandlerFuncEmptyIn(func() (uint32, error) {
@@ -101,5 +225,7 @@ func Run(port int, joinNetworkUrls ...string) {
 		return TotalWork(blockchain.LoadRangeSafe(0, math.MaxInt)).Bytes(), nil
 	}))
 
-	http.ListenAndServe(fmt.Sprintf(":%d", port), sm)
+	sm.HandleFunc("GET /api/gossip", handleGossip)
+
+	return sm
 }
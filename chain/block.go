@@ -4,34 +4,102 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"math/big"
 	"time"
 )
 
 var maxDifficultyTarget, _ = new(big.Int).SetString("00000000FFFF0000000000000000000000000000000000000000000000000000", 16)
 
-var firstTransaction = func() Transaction {
-	// todo serialize signed transaction and deserialize it here
-	pkBytes, err := hex.DecodeString("56b29cd95fb3ecc7e729e564d3af72e73d67e2d97d038d4937c6a487de282a0d")
+// The genesis block is hard-coded, every node must compute exactly the same block,
+// otherwise nodes would never agree on the PreviousHash of the first mined block.
+// Because the coinbase signature has a random ECDSA nonce, it was signed and mined once and serialized below.
+const (
+	genesisTimestamp = 1735689600 // 2025-01-01T00:00:00Z
+	genesisPublicKey = "027886c70d675574e581cf424d78092146024fa5bdaf91aab3b7a45e38720736e4"
+)
+
+type genesisParams struct {
+	// the initial difficulty of the network and the lowest one
+	Bits      uint32
+	Signature string
+	Nonce     uint32
+	// expected hash of the block, checked on startup
+	Hash string
+}
+
+var genesisParamsByNet = map[Net]genesisParams{
+	Mainnet: {
+		Bits:      0x1e03e7fc, // difficulty 0.001
+		Signature: "304502210092e52bcebc0b9b62dd2c9dba887d143323e13e0c30df1e7ea7872b42f51de2c202203802681318a42bc26ed6c98ab3794833cf5f2d06023fe3f9395b931c6ac7898d",
+		Nonce:     4420575,
+		Hash:      "000000ea8f76179d9df5a8b8f870f06f50cd7a9d325b99a2d154939a07a4f084",
+	},
+	Testnet: {
+		Bits:      0x1e03e7fc, // difficulty 0.001
+		Signature: "3044022031288cbc3e577fe404dee1eb9f14e5e3fc63bb507af18ebe40640fad87b91293022046c31897fa85f58334c344895b2f320e1c2a349b7343e09530820528a203e82b",
+		Nonce:     4208028,
+		Hash:      "000000f14e65b8671c20d84f6df16f6649a105f504d4bbc431b7e614780c97f1",
+	},
+	Regtest: {
+		Bits:      0x2005f5db, // difficulty 1e-8
+		Signature: "3045022100c6d63df8fb331b0b7c677ffd3a906fccab8bfd1d0059ec2fa5ea3b0fc4b38d1702205a96fe92711425f3c84278646fed779a409d790c6640aa1fe2cdff8ca752e16e",
+		Nonce:     26,
+		Hash:      "0591ff0d9899301100fac57bdba5f8368b3113573fc3224561a5e7f64fb22cc2",
+	},
+}
+
+var genesisBlock = newGenesisBlock(Mainnet)
+
+func newGenesisBlock(n Net) Block {
+	params, ok := genesisParamsByNet[n]
+	if !ok {
+		panic(fmt.Sprintf("no genesis block for network %x", byte(n)))
+	}
+	pubKeyBytes, err := hex.DecodeString(genesisPublicKey)
+	if err != nil {
+		panic(err)
+	}
+	pubKey, err := PublicKeyFromBytes(pubKeyBytes)
 	if err != nil {
 		panic(err)
 	}
-	pk := PrivateKeyFromBytes(pkBytes)
-	address := pk.PublicKey().Address(network)
-	tx, err := NewTransactionS(address, 50*Viatcoin).Sign(pk)
+	signature, err := hex.DecodeString(params.Signature)
 	if err != nil {
 		panic(err)
 	}
-	return tx
-}()
-var genesisBlock = Block{
-	Version:              1,
-	PreviousHash:         []byte{},
-	MerkleRoot:           calcMerkelRoot([]Transaction{firstTransaction}),
-	Timestamp:            uint32(time.Now().Unix()),
-	Nonce:                2083236893,
-	DifficultyTargetBits: targetToBits(maxDifficultyTarget),
-	Transactions:         []Transaction{firstTransaction},
+	address := pubKey.Address(n)
+	coinbase := Transaction{
+		Version:   1,
+		From:      address,
+		Transfers: []Transfer{{To: address, Amount: 50 * Viatcoin}},
+		Signature: signature,
+		PublicKey: pubKeyBytes,
+	}
+	return Block{
+		Version:              1,
+		PreviousHash:         []byte{},
+		MerkleRoot:           calcMerkelRoot([]Transaction{coinbase}),
+		Timestamp:            genesisTimestamp,
+		Nonce:                params.Nonce,
+		DifficultyTargetBits: params.Bits,
+		Transactions:         []Transaction{coinbase},
+	}
+}
+
+// checkGenesis makes sure this node computes the same genesis block as the rest of the network.
+func checkGenesis() error {
+	expected := genesisParamsByNet[network].Hash
+	if got := genesisBlock.HashString(); got != expected {
+		return fmt.Errorf("genesis block hash mismatch, expected=%s, got=%s", expected, got)
+	}
+	if !genesisBlock.Valid() {
+		return fmt.Errorf("genesis block doesn't meet its difficulty target")
+	}
+	if err := genesisBlock.Transactions[0].Verify(); err != nil {
+		return fmt.Errorf("genesis coinbase transaction is invalid: %s", err)
+	}
+	return nil
 }
 
 type Block struct {
@@ -53,18 +121,48 @@ type Block struct {
 	Transactions []Transaction
 }
 
+const BlockHeaderSize = 80
+
 // All fields are combined into an 80-byte block header.
 func (b Block) blockHeader() []byte {
-	buf := bytes.NewBuffer(make([]byte, 80))
+	buf := bytes.NewBuffer(make([]byte, 0, BlockHeaderSize))
 	buf.Write(uiLE(b.Version))
-	buf.Write(b.PreviousHash)
-	buf.Write(b.MerkleRoot)
+	buf.Write(hash32(b.PreviousHash)) // genesis has no previous hash
+	buf.Write(hash32(b.MerkleRoot))
 	buf.Write(uiLE(b.Timestamp))
 	buf.Write(uiLE(b.DifficultyTargetBits))
 	buf.Write(uiLE(b.Nonce))
 	return buf.Bytes()
 }
 
+// Header is the 80-byte block header, it's enough to verify the proof-of-work and the chaining.
+func (b Block) Header() []byte {
+	return b.blockHeader()
+}
+
+// ParseBlockHeader is the reverse of Block.Header, the returned block has no transactions.
+func ParseBlockHeader(h []byte) (Block, error) {
+	if len(h) != BlockHeaderSize {
+		return Block{}, fmt.Errorf("block header must be %d bytes, got=%d", BlockHeaderSize, len(h))
+	}
+	return Block{
+		Version:              binary.LittleEndian.Uint32(h[0:4]),
+		PreviousHash:         bytes.Clone(h[4:36]),
+		MerkleRoot:           bytes.Clone(h[36:68]),
+		Timestamp:            binary.LittleEndian.Uint32(h[68:72]),
+		DifficultyTargetBits: binary.LittleEndian.Uint32(h[72:76]),
+		Nonce:                binary.LittleEndian.Uint32(h[76:80]),
+	}, nil
+}
+
+// pads the hash with zeros to 32 bytes
+func hash32(h []byte) []byte {
+	if len(h) >= 32 {
+		return h[:32]
+	}
+	return append(h[:len(h):len(h)], make([]byte, 32-len(h))...)
+}
+
 func (b Block) Hash() []byte {
 	return doubleSHA256(b.blockHeader())
 }
@@ -103,9 +201,13 @@ func BitsToDifficutly(compact uint32) *big.Float {
 // reverse of bitsToTarget
 func targetToBits(target *big.Int) uint32 {
 	bs := target.Bytes()
+	if len(bs) < 3 {
+		bs = append(make([]byte, 3-len(bs)), bs...)
+	}
 	coefficient := bs[0:3]
 	shift := len(bs[3:])
-	if bs[0] >= 80 {
+	// the coefficient is signed, its highest bit must stay zero
+	if bs[0] >= 0x80 {
 		coefficient = []byte{0, bs[0], bs[1]}
 		shift = len(bs[2:])
 	}
@@ -159,41 +261,6 @@ func bi(v []byte) *big.Int {
 	return new(big.Int).SetBytes(v)
 }
 
-type pair struct {
-	first  []byte
-	second []byte
-}
-
-func (p pair) DoubleSha256() []byte {
-	return doubleSHA256(append(p.first, p.second...))
-}
-
-type shaable interface {
-	DoubleSha256() []byte
-}
-
-func calcMerkelRoot[T shaable](list []T) []byte {
-	if len(list) == 1 {
-		return list[0].DoubleSha256()
-	}
-	if len(list) == 2 {
-		return doubleSHA256(append(list[0].DoubleSha256(), list[1].DoubleSha256()...))
-	}
-	var newList []pair
-	var firstInPair []byte
-	for i, t := range list {
-		if i%2 == 0 {
-			firstInPair = t.DoubleSha256()
-		} else {
-			newList = append(newList, pair{first: firstInPair, second: t.DoubleSha256()})
-		}
-	}
-	if len(list)%2 == 1 {
-		newList = append(newList, pair{first: firstInPair, second: firstInPair})
-	}
-	return calcMerkelRoot(newList)
-}
-
 func NewBlock(previousHash []byte, selected []Transaction, netDifficutlyBits uint32) Block {
 	return Block{
 		PreviousHash:         previousHash,
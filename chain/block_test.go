@@ -78,26 +78,142 @@ func TestDifficultyToBits(t *testing.T) {
 }
 
 func TestAdjustDifficulty(t *testing.T) {
+	resetBlockchain(t)
+	withNetParams(t, netParams{TargetBlockInterval: 10 * time.Minute, RetargetWindow: 2})
+
+	b := mineEasyBlock(t, genesisBlock) // a block every second, way faster than expected
+	err := Broadcast(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisTarget := bitsToTarget(genesisBlock.DifficultyTargetBits)
+	got := bitsToTarget(GetDiffuctlyTargetBits())
+	if got.Cmp(genesisTarget) >= 0 {
+		t.Fatal("difficulty should've increased after one block: ", got.Text(16))
+	}
+	// the adjustment is clamped to 4x
+	clamped := bitsToTarget(targetToBits(new(big.Int).Div(genesisTarget, big.NewInt(maxRetargetFactor))))
+	if got.Cmp(clamped) != 0 {
+		t.Errorf("expected the target to be clamped to %s, got=%s", clamped.Text(16), got.Text(16))
+	}
+}
+
+func TestRegtestNoRetarget(t *testing.T) {
+	resetBlockchain(t)
+	// a block every second, the other nets would raise the difficulty 4x
+	blockAt := func(height int) Block {
+		if height == 0 {
+			return genesisBlock
+		}
+		return Block{Timestamp: genesisBlock.Timestamp + uint32(height), DifficultyTargetBits: genesisBlock.DifficultyTargetBits}
+	}
+	if bits := nextWorkRequired(NumBlocksAdjust, blockAt); bits != genesisBlock.DifficultyTargetBits {
+		t.Errorf("regtest difficulty mustn't change, bits=%x", bits)
+	}
+}
+
+func withNetParams(t *testing.T, p netParams) {
+	old := netParamsByNet[network]
+	netParamsByNet[network] = p
+	n := network
+	t.Cleanup(func() { netParamsByNet[n] = old })
+}
+
+func TestGenesisBlock(t *testing.T) {
 	t.Cleanup(func() {
-		blockchain.Clear()
+		SetNetwork(Mainnet)
 	})
-	const d = 1e-10
-	diffic := new(big.Float).SetFloat64(d) // basically any block hash will do
-	pk := mustPrivKey()
-	ct, err := NewTransactionS(pk.PublicKey().Address(Mainnet), GetMinerReward()).Sign(pk)
-	if err != nil {
+	for _, n := range []Net{Mainnet, Testnet, Regtest} {
+		SetNetwork(n)
+		if err := checkGenesis(); err != nil {
+			t.Errorf("network %x: %s", byte(n), err)
+		}
+		if !newGenesisBlock(n).Equals(GetLastBlock()) {
+			t.Errorf("network %x: genesis block isn't deterministic", byte(n))
+		}
+	}
+	if newGenesisBlock(Mainnet).Equals(newGenesisBlock(Testnet)) {
+		t.Error("networks should have different genesis blocks")
+	}
+}
+
+func TestConsensusDifficultyBits(t *testing.T) {
+	resetBlockchain(t)
+	b1 := mineEasyBlock(t, genesisBlock)
+	// the miner picks an easier target than the network's
+	easier := b1
+	easier.DifficultyTargetBits = DiffucltyToBits(new(big.Float).SetFloat64(1e-10))
+	easier = mine(easier)
+	if err := Broadcast(easier); err == nil {
+		t.Error("block with easier difficulty bits must be rejected")
+	}
+	if err := verifyHeader(easier, 1, blockchain.LoadIndex); err == nil {
+		t.Error("header with easier difficulty bits must be rejected")
+	}
+	if err := verifyHeader(b1, 1, blockchain.LoadIndex); err != nil {
+		t.Error(err)
+	}
+	if err := Broadcast(b1); err != nil {
 		t.Fatal(err)
 	}
-	b := NewBlock(genesisBlock.Hash(), []Transaction{ct}, DiffucltyToBits(diffic))
-	if !b.Valid() {
-		t.Fatalf("block invalid: %v", b)
+}
+
+func TestNextWorkRequired(t *testing.T) {
+	resetBlockchain(t)
+	withNetParams(t, netParams{TargetBlockInterval: time.Minute, RetargetWindow: 10})
+	blocks := []Block{genesisBlock}
+	blockAt := func(h int) Block { return blocks[h] }
+	next := func(interval uint32) Block {
+		b := blocks[len(blocks)-1]
+		b.PreviousHash = b.Hash()
+		b.Timestamp += interval
+		b.DifficultyTargetBits = nextWorkRequired(len(blocks), blockAt)
+		blocks = append(blocks, b)
+		return b
 	}
-	b.Timestamp = uint32(time.Now().Unix() + 1) // otherwise genesis will have the same timestamp
-	err = doBroadcast(b, diffic, 2)
-	if err != nil {
+
+	for i := 0; i < 9; i++ {
+		if next(30).DifficultyTargetBits != genesisBlock.DifficultyTargetBits {
+			t.Fatal("difficulty must not change between adjustments")
+		}
+	}
+	// 9 intervals of 30 seconds instead of 10 minutes
+	harder := next(30)
+	expected := new(big.Int).Mul(bitsToTarget(genesisBlock.DifficultyTargetBits), big.NewInt(270))
+	expected.Div(expected, big.NewInt(600))
+	if harder.DifficultyTargetBits != targetToBits(expected) {
+		t.Errorf("expected bits %x, got=%x", targetToBits(expected), harder.DifficultyTargetBits)
+	}
+
+	for i := 0; i < 10; i++ {
+		next(3600)
+	}
+	// slow blocks can't make it easier than the genesis
+	if blocks[len(blocks)-1].DifficultyTargetBits != genesisBlock.DifficultyTargetBits {
+		t.Errorf("difficulty can't go below the genesis, got bits=%x", blocks[len(blocks)-1].DifficultyTargetBits)
+	}
+}
+
+func TestCoinbaseHeight(t *testing.T) {
+	resetBlockchain(t)
+	b1 := mineEasyBlock(t, genesisBlock)
+	if err := Broadcast(b1); err != nil {
 		t.Fatal(err)
 	}
-	if diffic.Cmp(new(big.Float).SetFloat64(d)) != 1 {
-		t.Error("difficulty should've increased after one block: ", diffic.String())
+	// the coinbase of block 1 copied byte for byte
+	copied := NewBlock(b1.Hash(), []Transaction{b1.Transactions[0]}, GetDiffuctlyTargetBits())
+	copied.Timestamp = b1.Timestamp + 1
+	if err := Broadcast(mine(copied)); err == nil {
+		t.Fatal("coinbase of another height must be rejected")
+	}
+	withoutHeight := b1.Transactions[0]
+	withoutHeight.ExtraNonce = nil
+	b := NewBlock(b1.Hash(), []Transaction{withoutHeight}, GetDiffuctlyTargetBits())
+	b.Timestamp = b1.Timestamp + 1
+	if err := Broadcast(mine(b)); err == nil {
+		t.Fatal("coinbase without the height must be rejected")
+	}
+	if err := Broadcast(mineEasyBlock(t, b1)); err != nil {
+		t.Fatal(err)
 	}
 }
@@ -0,0 +1,249 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Canonical binary encoding of transactions and blocks.
+// Unlike gob, the output doesn't depend on Go, so any client can sign and hash transactions.
+//
+// Integers are little-endian, uint32 or uint64.
+// Strings and byte slices are prefixed with their uint32 length.
+// Every top-level encoding starts with the encodingVersion byte.
+//
+//	Transfer:    To | Amount u64
+//	Transaction: version byte | Version u32 | From | Nonce u64 | Fee u64 | count u32 | Transfer... | Signature | PublicKey | ExtraNonce
+//	Block:       version byte | 80-byte header | count u32 | length-prefixed Transaction...
+//
+// The transaction without Signature, PublicKey and ExtraNonce is what gets signed, see Transaction.Serialize.
+// The double SHA-256 of the whole transaction encoding is the txid, see Transaction.ID.
+const encodingVersion byte = 1
+
+// encodings longer than that are rejected, so that a forged length can't allocate gigabytes.
+const maxEncodedSize = 32 << 20
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.buf.Write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.u32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *encoder) string(v string) {
+	e.bytes([]byte(v))
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = fmt.Errorf("unexpected end of data")
+		return nil
+	}
+	res := d.b[:n]
+	d.b = d.b[n:]
+	return res
+}
+
+func (d *decoder) byte() byte {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) u32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) u64() uint64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.u32()
+	b := d.take(int(n))
+	if b == nil {
+		return nil
+	}
+	return bytes.Clone(b)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// count reads the number of the following elements, each taking at least minSize bytes.
+func (d *decoder) count(minSize int) int {
+	n := d.u32()
+	if d.err == nil && int(n) > len(d.b)/minSize {
+		d.err = fmt.Errorf("element count %d exceeds the data", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) version() {
+	if v := d.byte(); d.err == nil && v != encodingVersion {
+		d.err = fmt.Errorf("unsupported encoding version %d", v)
+	}
+}
+
+// finish fails if there are bytes left, every value has exactly one encoding.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.b) > 0 {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.b))
+	}
+	return d.err
+}
+
+func newDecoder(b []byte) *decoder {
+	if len(b) > maxEncodedSize {
+		return &decoder{err: fmt.Errorf("encoding exceeds %d bytes", maxEncodedSize)}
+	}
+	return &decoder{b: b}
+}
+
+func (tf Transfer) encode(e *encoder) {
+	e.string(tf.To)
+	e.u64(uint64(tf.Amount))
+}
+
+func decodeTransfer(d *decoder) Transfer {
+	return Transfer{To: d.string(), Amount: Coin(d.u64())}
+}
+
+// Encode returns the canonical encoding of the transfer.
+func (tf Transfer) Encode() []byte {
+	var e encoder
+	e.buf.WriteByte(encodingVersion)
+	tf.encode(&e)
+	return e.buf.Bytes()
+}
+
+func DecodeTransfer(b []byte) (Transfer, error) {
+	d := newDecoder(b)
+	d.version()
+	tf := decodeTransfer(d)
+	if err := d.finish(); err != nil {
+		return Transfer{}, fmt.Errorf("decode transfer: %s", err)
+	}
+	return tf, nil
+}
+
+// encodeUnsigned writes everything except the signature and the public key.
+func (t Transaction) encodeUnsigned(e *encoder) {
+	e.buf.WriteByte(encodingVersion)
+	e.u32(t.Version)
+	e.string(t.From)
+	e.u64(t.Nonce)
+	e.u64(uint64(t.Fee))
+	e.u32(uint32(len(t.Transfers)))
+	for _, tf := range t.Transfers {
+		tf.encode(e)
+	}
+}
+
+// Encode returns the canonical encoding of the signed transaction.
+func (t Transaction) Encode() []byte {
+	var e encoder
+	t.encodeUnsigned(&e)
+	e.bytes(t.Signature)
+	e.bytes(t.PublicKey)
+	e.bytes(t.ExtraNonce)
+	return e.buf.Bytes()
+}
+
+func decodeTransaction(d *decoder) Transaction {
+	d.version()
+	t := Transaction{
+		Version: d.u32(),
+		From:    d.string(),
+		Nonce:   d.u64(),
+		Fee:     Coin(d.u64()),
+	}
+	n := d.count(12) // empty address and amount
+	for i := 0; i < n; i++ {
+		t.Transfers = append(t.Transfers, decodeTransfer(d))
+	}
+	t.Signature = d.bytes()
+	t.PublicKey = d.bytes()
+	if extraNonce := d.bytes(); len(extraNonce) > 0 {
+		t.ExtraNonce = extraNonce
+	}
+	return t
+}
+
+// DecodeTransaction is the reverse of Transaction.Encode.
+func DecodeTransaction(b []byte) (Transaction, error) {
+	d := newDecoder(b)
+	t := decodeTransaction(d)
+	if err := d.finish(); err != nil {
+		return Transaction{}, fmt.Errorf("decode transaction: %s", err)
+	}
+	return t, nil
+}
+
+// Encode returns the canonical encoding of the block with its transactions.
+func (b Block) Encode() []byte {
+	var e encoder
+	e.buf.WriteByte(encodingVersion)
+	e.buf.Write(b.blockHeader())
+	e.u32(uint32(len(b.Transactions)))
+	for _, t := range b.Transactions {
+		e.bytes(t.Encode())
+	}
+	return e.buf.Bytes()
+}
+
+// DecodeBlock is the reverse of Block.Encode.
+func DecodeBlock(b []byte) (Block, error) {
+	d := newDecoder(b)
+	d.version()
+	block, err := ParseBlockHeader(d.take(BlockHeaderSize))
+	if d.err != nil {
+		return Block{}, fmt.Errorf("decode block: %s", d.err)
+	}
+	if err != nil {
+		return Block{}, err
+	}
+	n := d.count(4)
+	for i := 0; i < n && d.err == nil; i++ {
+		t, err := DecodeTransaction(d.bytes())
+		if err != nil {
+			return Block{}, fmt.Errorf("decode block: transaction %d: %s", i, err)
+		}
+		block.Transactions = append(block.Transactions, t)
+	}
+	if err := d.finish(); err != nil {
+		return Block{}, fmt.Errorf("decode block: %s", err)
+	}
+	return block, nil
+}
@@ -0,0 +1,112 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// golden vectors, any change to them breaks signatures and hashes of the existing blockchain.
+const (
+	goldenTransfer    = "0103000000626f620500000000000000"
+	goldenTransaction = "0101000000040000006164647207000000000000002c010000000000000100000003000000626f62050000000000000002000000aabb02000000020300000000"
+	goldenBlock       = "0101000000" +
+		"1111111111111111111111111111111111111111111111111111111111111111" +
+		"2222222222222222222222222222222222222222222222222222222222222222" +
+		"04030201ffff001d2a000000" +
+		"0100000040000000" + goldenTransaction
+)
+
+func goldenTx() Transaction {
+	return Transaction{
+		Version:   1,
+		From:      "addr",
+		Nonce:     7,
+		Fee:       300,
+		Transfers: []Transfer{{To: "bob", Amount: 5}},
+		Signature: []byte{0xaa, 0xbb},
+		PublicKey: []byte{0x02, 0x03},
+	}
+}
+
+func TestEncodingGoldenVectors(t *testing.T) {
+	if got := hex.EncodeToString(Transfer{To: "bob", Amount: 5}.Encode()); got != goldenTransfer {
+		t.Errorf("transfer encoding changed: %s", got)
+	}
+	tx := goldenTx()
+	if got := hex.EncodeToString(tx.Encode()); got != goldenTransaction {
+		t.Errorf("transaction encoding changed: %s", got)
+	}
+	b := Block{
+		Version:              1,
+		PreviousHash:         bytes.Repeat([]byte{0x11}, 32),
+		MerkleRoot:           bytes.Repeat([]byte{0x22}, 32),
+		Timestamp:            0x01020304,
+		DifficultyTargetBits: 0x1d00ffff,
+		Nonce:                42,
+		Transactions:         []Transaction{tx},
+	}
+	if got := hex.EncodeToString(b.Encode()); got != goldenBlock {
+		t.Errorf("block encoding changed: %s", got)
+	}
+
+	// the signed part is the transaction without the signature, the public key and the extra nonce
+	ser, err := tx.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(tx.Encode(), ser) || len(tx.Encode())-len(ser) != 16 {
+		t.Error("serialization for signing must be the encoding without the signature, the public key and the extra nonce")
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	raw, _ := hex.DecodeString(goldenBlock)
+	b, err := DecodeBlock(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Encode(), raw) {
+		t.Error("block round trip failed")
+	}
+	if b.Transactions[0].Fee != 300 || b.Transactions[0].Transfers[0].To != "bob" {
+		t.Errorf("unexpected decoded transaction: %+v", b.Transactions[0])
+	}
+
+	tf, err := DecodeTransfer(Transfer{To: "alice", Amount: Viatcoin}.Encode())
+	if err != nil || tf.To != "alice" || tf.Amount != Viatcoin {
+		t.Errorf("transfer round trip failed: %+v, %v", tf, err)
+	}
+
+	signed, err := NewTransactionS(mustPrivKey().PublicKey().Address(network), 1).Sign(mustPrivKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeTransaction(signed.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Verify(); err != nil {
+		t.Error("decoded transaction must stay verifiable: ", err)
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	raw, _ := hex.DecodeString(goldenTransaction)
+	if _, err := DecodeTransaction(append(bytes.Clone(raw), 0)); err == nil {
+		t.Error("trailing bytes must be rejected")
+	}
+	if _, err := DecodeTransaction(raw[:len(raw)-1]); err == nil {
+		t.Error("truncated transaction must be rejected")
+	}
+	unknown := append([]byte{2}, raw[1:]...)
+	if _, err := DecodeTransaction(unknown); err == nil {
+		t.Error("unknown encoding version must be rejected")
+	}
+	// transfer count claiming more elements than the data has
+	forged := bytes.Clone(raw)
+	copy(forged[29:33], []byte{0xff, 0xff, 0xff, 0x7f})
+	if _, err := DecodeTransaction(forged); err == nil {
+		t.Error("forged count must be rejected")
+	}
+}
@@ -0,0 +1,288 @@
+package chain
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glossd/viatcoin/chain/util"
+)
+
+// Gossip is a push-based protocol over persistent connections, like Bitcoin's inv/getdata.
+// A node announces hashes of newly accepted blocks and transactions with an inv message,
+// peers which don't have them ask for the content with getdata and the node replies with a block or tx message.
+// Connections are opened by upgrading the GET /api/gossip request, so the node needs only one port.
+// Each message is a JSON object on its own line, blocks and transactions are in their canonical binary encoding.
+
+const (
+	msgHello   = "hello"
+	msgInv     = "inv"
+	msgGetData = "getdata"
+	msgBlock   = "block"
+	msgTx      = "tx"
+
+	invBlock = "block"
+	invTx    = "tx"
+)
+
+const gossipUpgrade = "viatcoin-gossip"
+
+var gossipReconnectDelay = 5 * time.Second
+
+type gossipMessage struct {
+	Type string
+	// hello: port of the sender's API, so that the receiver can fall back to syncing via the API.
+	Port int `json:",omitempty"`
+	// hello: unix time of the sender, for the network-adjusted time.
+	Time int64 `json:",omitempty"`
+	// inv and getdata: either block or tx
+	Kind   string   `json:",omitempty"`
+	Hashes []string `json:",omitempty"`
+
+	// Block.Encode
+	Block []byte `json:",omitempty"`
+	// Transaction.Encode
+	Tx []byte `json:",omitempty"`
+}
+
+type peer struct {
+	// filled after hello, empty if the peer doesn't serve the API.
+	apiUrl string
+	conn   net.Conn
+	r      *bufio.Reader
+	mu     sync.Mutex // guards writes to conn
+	enc    *json.Encoder
+}
+
+// keyed by remote address
+var peers = util.Map[string, *peer]{}
+
+// port of this node's API, sent to peers in hello.
+var apiPort int
+
+func newPeer(conn net.Conn, r *bufio.Reader) *peer {
+	return &peer{conn: conn, r: r, enc: json.NewEncoder(conn)}
+}
+
+func (p *peer) send(m gossipMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return p.enc.Encode(m)
+}
+
+// serve registers the peer and handles its messages until the connection breaks.
+func (p *peer) serve() error {
+	key := p.conn.RemoteAddr().String()
+	peers.Store(key, p)
+	defer func() {
+		peers.Delete(key)
+		removeTimeSample(key)
+		p.conn.Close()
+	}()
+
+	if err := p.send(gossipMessage{Type: msgHello, Port: apiPort, Time: time.Now().Unix()}); err != nil {
+		return err
+	}
+	// let the peer know our tip, if it doesn't have it, it will ask for it and catch up.
+	if err := p.send(gossipMessage{Type: msgInv, Kind: invBlock, Hashes: []string{GetLastBlock().HashString()}}); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(p.r)
+	for {
+		var m gossipMessage
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := p.handle(m); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *peer) handle(m gossipMessage) error {
+	switch m.Type {
+	case msgHello:
+		if m.Time > 0 {
+			addTimeSample(p.conn.RemoteAddr().String(), time.Unix(m.Time, 0))
+		}
+		if m.Port > 0 && p.apiUrl == "" {
+			host, _, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+			if err == nil {
+				p.apiUrl = "http://" + net.JoinHostPort(host, strconv.Itoa(m.Port))
+			}
+		}
+	case msgInv:
+		var missing []string
+		for _, h := range m.Hashes {
+			if !hasInventory(m.Kind, h) {
+				missing = append(missing, h)
+			}
+		}
+		if len(missing) > 0 {
+			return p.send(gossipMessage{Type: msgGetData, Kind: m.Kind, Hashes: missing})
+		}
+	case msgGetData:
+		for _, h := range m.Hashes {
+			switch m.Kind {
+			case invBlock:
+				if b, ok := blockchain.Load(h); ok {
+					if err := p.send(gossipMessage{Type: msgBlock, Block: b.Encode()}); err != nil {
+						return err
+					}
+				}
+			case invTx:
+				if t, ok := memPool.Load(h); ok {
+					if err := p.send(gossipMessage{Type: msgTx, Tx: t.Encode()}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	case msgBlock:
+		b, err := DecodeBlock(m.Block)
+		if err != nil {
+			return err
+		}
+		p.onBlock(b)
+	case msgTx:
+		t, err := DecodeTransaction(m.Tx)
+		if err != nil {
+			return err
+		}
+		if err := Push(t); err != nil {
+			log.Printf("gossip: rejected transaction, tx_id=%s, peer=%s: %s", t.ID(), p.conn.RemoteAddr(), err)
+		}
+	default:
+		return fmt.Errorf("unknown gossip message type: %s", m.Type)
+	}
+	return nil
+}
+
+func (p *peer) onBlock(b Block) {
+	if _, ok := blockchain.Load(b.HashString()); ok {
+		return
+	}
+	err := Broadcast(b)
+	if err == nil {
+		return
+	}
+	if _, ok := blockchain.Load(hex.EncodeToString(b.PreviousHash)); ok || p.apiUrl == "" {
+		log.Printf("gossip: rejected block, hash=%s, peer=%s: %s", b.HashString(), p.conn.RemoteAddr(), err)
+		return
+	}
+	// the parent is unknown, we're behind or on another branch.
+	if err := syncFrom(p.apiUrl); err != nil {
+		log.Printf("gossip: failed to sync, url=%s: %s", p.apiUrl, err)
+	}
+}
+
+func hasInventory(kind, hash string) bool {
+	switch kind {
+	case invBlock:
+		_, ok := blockchain.Load(hash)
+		return ok
+	case invTx:
+		_, ok := memPool.Load(hash)
+		return ok
+	}
+	// unknown kind, nothing to ask for
+	return true
+}
+
+func announce(kind, hash string) {
+	m := gossipMessage{Type: msgInv, Kind: kind, Hashes: []string{hash}}
+	peers.Range(func(key string, p *peer) bool {
+		if err := p.send(m); err != nil {
+			log.Printf("gossip: failed to announce, peer=%s: %s", key, err)
+		}
+		return true
+	})
+}
+
+// handleGossip upgrades the HTTP connection of an incoming peer.
+func handleGossip(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != gossipUpgrade {
+		http.Error(w, "expected Upgrade: "+gossipUpgrade, http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("gossip: hijack failed: %s", err)
+		return
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", gossipUpgrade)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if err := newPeer(conn, rw.Reader).serve(); err != nil {
+		log.Printf("gossip: peer disconnected, addr=%s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// dialGossip opens a gossip connection to the node's API.
+func dialGossip(apiUrl string) (*peer, error) {
+	if !strings.Contains(apiUrl, "://") {
+		apiUrl = "http://" + apiUrl
+	}
+	u, err := url.Parse(apiUrl)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(conn, "GET /api/gossip HTTP/1.1\r\nHost: %s\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", u.Host, gossipUpgrade)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("gossip upgrade refused: %s", resp.Status)
+	}
+	p := newPeer(conn, r)
+	p.apiUrl = strings.TrimSuffix(apiUrl, "/")
+	return p, nil
+}
+
+// gossipWith keeps a connection to the node open, reconnecting when it breaks.
+func gossipWith(apiUrl string) {
+	for {
+		p, err := dialGossip(apiUrl)
+		if err == nil {
+			err = p.serve()
+		}
+		if err != nil {
+			log.Printf("gossip: connection lost, url=\"%s\", error: %s", apiUrl, err)
+		}
+		time.Sleep(gossipReconnectDelay)
+	}
+}
@@ -0,0 +1,120 @@
+package chain
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// connects a fake remote node to this node
+func pipePeer(t *testing.T) (*json.Decoder, *json.Encoder) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	go newPeer(local, bufio.NewReader(local)).serve()
+
+	dec, enc := json.NewDecoder(remote), json.NewEncoder(remote)
+	expectMessage(t, dec, msgHello)
+	tip := expectMessage(t, dec, msgInv)
+	if tip.Hashes[0] != GetLastBlock().HashString() {
+		t.Fatalf("expected the tip to be announced, got=%v", tip.Hashes)
+	}
+	return dec, enc
+}
+
+func expectMessage(t *testing.T, dec *json.Decoder, typ string) gossipMessage {
+	t.Helper()
+	var m gossipMessage
+	if err := dec.Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != typ {
+		t.Fatalf("expected %s message, got=%s", typ, m.Type)
+	}
+	return m
+}
+
+func TestGossipBlockAndTransaction(t *testing.T) {
+	resetBlockchain(t)
+	dec, enc := pipePeer(t)
+
+	alice := mustPrivKey()
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+
+	// remote mined a block
+	if err := enc.Encode(gossipMessage{Type: msgInv, Kind: invBlock, Hashes: []string{b1.HashString()}}); err != nil {
+		t.Fatal(err)
+	}
+	getData := expectMessage(t, dec, msgGetData)
+	if getData.Kind != invBlock || getData.Hashes[0] != b1.HashString() {
+		t.Fatalf("unexpected getdata: %v", getData)
+	}
+	if err := enc.Encode(gossipMessage{Type: msgBlock, Block: b1.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	// the accepted block is relayed to every peer
+	relayed := expectMessage(t, dec, msgInv)
+	if relayed.Kind != invBlock || relayed.Hashes[0] != b1.HashString() {
+		t.Fatalf("unexpected inv: %v", relayed)
+	}
+	if !GetLastBlock().Equals(b1) {
+		t.Fatal("block wasn't added to the blockchain")
+	}
+
+	tx, err := NewTransactionS(mustPrivKey().PublicKey().Address(network), 10).Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(gossipMessage{Type: msgInv, Kind: invTx, Hashes: []string{tx.ID()}}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, dec, msgGetData)
+	if err := enc.Encode(gossipMessage{Type: msgTx, Tx: tx.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	relayed = expectMessage(t, dec, msgInv)
+	if relayed.Kind != invTx || relayed.Hashes[0] != tx.ID() {
+		t.Fatalf("unexpected inv: %v", relayed)
+	}
+	if _, ok := Get(tx.ID()); !ok {
+		t.Error("transaction wasn't added to the mempool")
+	}
+
+	// known inventory isn't requested again
+	if err := enc.Encode(gossipMessage{Type: msgInv, Kind: invTx, Hashes: []string{tx.ID()}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(gossipMessage{Type: msgGetData, Kind: invTx, Hashes: []string{tx.ID()}}); err != nil {
+		t.Fatal(err)
+	}
+	served := expectMessage(t, dec, msgTx)
+	if servedTx, err := DecodeTransaction(served.Tx); err != nil || servedTx.ID() != tx.ID() {
+		t.Errorf("served wrong transaction: %v, %v", servedTx, err)
+	}
+}
+
+func TestReorgAnnouncesTip(t *testing.T) {
+	resetBlockchain(t)
+	b1 := mineEasyBlock(t, genesisBlock)
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	a2 := mineEasyBlock(t, b1)
+	if err := Broadcast(a2); err != nil {
+		t.Fatal(err)
+	}
+	c2 := mineEasyBlock(t, b1)
+	c3 := mineEasyBlock(t, c2)
+	dec, _ := pipePeer(t)
+
+	// blocks connected by syncing, not by gossip, are relayed too
+	errc := make(chan error, 1)
+	go func() { errc <- reorganize([]Block{c2, c3}) }()
+	relayed := expectMessage(t, dec, msgInv)
+	if relayed.Kind != invBlock || relayed.Hashes[0] != c3.HashString() {
+		t.Fatalf("expected the new tip to be announced, got=%v", relayed)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
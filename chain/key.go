@@ -1,12 +1,14 @@
 package chain
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/hex"
 
 	"github.com/decred/base58"
 	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
 	"golang.org/x/crypto/ripemd160"
 )
 
@@ -31,8 +33,20 @@ func (p *PrivateKey) Bytes() []byte {
 	return p.key.Serialize()
 }
 
-func (p *PrivateKey) Sign(in []byte) ([]byte, error) {
-	return p.key.ToECDSA().Sign(rand.Reader, in, nil)
+// Sign signs the hash and returns the DER encoded signature with the low S.
+// Both (R, S) and (R, N-S) are valid, only the low one is accepted by Verify,
+// otherwise anyone could flip S of a broadcasted transaction and change its txid.
+func (p *PrivateKey) Sign(hash []byte) ([]byte, error) {
+	der, err := p.key.ToECDSA().Sign(rand.Reader, hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := secpecdsa.ParseDERSignature(der)
+	if err != nil {
+		return nil, err
+	}
+	// Serialize normalizes S
+	return sig.Serialize(), nil
 }
 
 func (p *PublicKey) Bytes() []byte {
@@ -52,8 +66,16 @@ func PublicKeyFromBytes(serialized []byte) (*PublicKey, error) {
 	return &PublicKey{key: res}, nil
 }
 
-func (p *PublicKey) Verify(txData []byte, signature []byte) bool {
-	return ecdsa.VerifyASN1(p.key.ToECDSA(), txData, signature)
+// Verify accepts only the canonical signature, see Sign.
+func (p *PublicKey) Verify(hash []byte, signature []byte) bool {
+	sig, err := secpecdsa.ParseDERSignature(signature)
+	if err != nil {
+		return false
+	}
+	if s := sig.S(); s.IsOverHalfOrder() || !bytes.Equal(sig.Serialize(), signature) {
+		return false
+	}
+	return ecdsa.VerifyASN1(p.key.ToECDSA(), hash, signature)
 }
 
 func (p *PublicKey) publicKeyHash() []byte {
@@ -1,6 +1,12 @@
 package chain
 
-import "testing"
+import (
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
 
 func TestSignAndVerify(t *testing.T) {
 	prv, err := NewPrivateKey()
@@ -16,3 +22,29 @@ func TestSignAndVerify(t *testing.T) {
 		t.Error("signature should've been verified")
 	}
 }
+
+func TestRejectHighS(t *testing.T) {
+	prv := mustPrivKey()
+	hash := doubleSHA256([]byte{1, 2, 3, 4})
+	der, err := prv.Sign(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		t.Fatal(err)
+	}
+	n := secp256k1.S256().N
+	if sig.S.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		t.Fatal("Sign must produce the low S")
+	}
+	// (R, N-S) is just as valid mathematically
+	sig.S.Sub(n, sig.S)
+	flipped, err := asn1.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prv.PublicKey().Verify(hash, flipped) {
+		t.Error("high S signature must be rejected")
+	}
+}
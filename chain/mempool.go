@@ -1,88 +1,332 @@
 package chain
 
 import (
+	"cmp"
 	"fmt"
 	"github.com/glossd/viatcoin/chain/util"
+	"slices"
+	"sync"
 )
 
 // bitcoin is using levelDB. It's persistent kv-storage sorted by keys.
-// todo after adding miner fee, sort the transaction by it
 var memPool = util.Map[string, Transaction]{}
 
 var wallets = util.Map[string, []int64]{}
 
+// next expected transaction nonce per address
+var nonces = util.Map[string, uint64]{}
+
+// guards the check of the pending spends and the store, otherwise two transactions could overdraw concurrently.
+var pushLock sync.Mutex
+
 func Push(t Transaction) error {
-	err := verifyTx(t)
+	if err := push(t); err != nil {
+		return err
+	}
+	// outside of the lock, a slow peer mustn't hold up the other transactions
+	announce(invTx, t.ID())
+	return nil
+}
+
+func push(t Transaction) error {
+	pushLock.Lock()
+	defer pushLock.Unlock()
+	pending, err := pendingSpend(t.From)
 	if err != nil {
 		return err
 	}
+	err = verifyTx(t, pending)
+	if err != nil {
+		return err
+	}
+	if id, ok := pendingWithNonce(t.From, t.Nonce); ok && id != t.ID() {
+		return fmt.Errorf("nonce is already pending, nonce=%d, tx_id=%s", t.Nonce, id)
+	}
 
-	_, ok := memPool.LoadOrStore(t.ID, t)
+	_, ok := memPool.LoadOrStore(t.ID(), t)
 	if ok {
-		return fmt.Errorf("transaciont already exists: %s", t.ID)
+		return fmt.Errorf("transaciont already exists: %s", t.ID())
 	}
 	return nil
 }
 
-func verifyTx(t Transaction) error {
+// InsufficientFundsError means the sender's balance doesn't cover the transaction
+// together with the sender's other transactions, which are in the mempool or in the same block.
+type InsufficientFundsError struct {
+	Address  string
+	Required Coin
+	// spent by the other transactions
+	Pending Coin
+	Balance Coin
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("insufficient funds including pending: address=%s, required=%f, pending=%f, balance=%f",
+		e.Address, e.Required.AsViatcoins(), e.Pending.AsViatcoins(), e.Balance.AsViatcoins())
+}
+
+// verifyTx checks the transaction against the blockchain, pending is what the sender has already spent
+// in the transactions which would be applied before this one.
+func verifyTx(t Transaction, pending Coin) error {
 	if err := t.Verify(); err != nil {
 		return err
 	}
+	if len(t.ExtraNonce) > 0 {
+		return fmt.Errorf("only the coinbase can have an extra nonce")
+	}
+	if next := NextNonce(t.From); t.Nonce < next {
+		return fmt.Errorf("nonce already used, nonce=%d, next=%d", t.Nonce, next)
+	}
 
-	var fullAmount Coin
-	for _, tf := range t.Transfers {
-		fullAmount += tf.Amount
+	fullAmount, err := t.fullAmount()
+	if err != nil {
+		return err
 	}
 	balance := Balance(t.From)
-	if fullAmount > balance {
-		return fmt.Errorf("the amount in trasfers exceeded wallet balance, required=%f, balance=%f", fullAmount.AsViatcoins(), balance.AsViatcoins())
+	if pending > balance || fullAmount > balance-pending {
+		return &InsufficientFundsError{Address: t.From, Required: fullAmount, Pending: pending, Balance: balance}
 	}
 
 	return nil
 }
 
+// fullAmount is what the sender pays, the transfers and the fee.
+// Transactions without transfers, with zero transfers or with amounts beyond MaxMoney are rejected.
+func (t Transaction) fullAmount() (Coin, error) {
+	if len(t.Transfers) == 0 {
+		return 0, fmt.Errorf("transaction has no transfers")
+	}
+	sum := t.Fee
+	for i, tf := range t.Transfers {
+		if tf.Amount == 0 {
+			return 0, fmt.Errorf("transfer %d has zero amount", i)
+		}
+		var err error
+		sum, err = sum.Add(tf.Amount)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return sum, nil
+}
+
+// pendingSpend sums what the address spends in the mempool transactions.
+// Transactions with used nonces can never be mined, they don't count.
+func pendingSpend(address string) (Coin, error) {
+	var sum Coin
+	var err error
+	next := NextNonce(address)
+	memPool.Range(func(_ string, t Transaction) bool {
+		if t.From != address || t.Nonce < next {
+			return true
+		}
+		var amount Coin
+		amount, err = t.fullAmount()
+		if err == nil {
+			sum, err = sum.Add(amount)
+		}
+		return err == nil
+	})
+	return sum, err
+}
+
+// pendingWithNonce finds the mempool transaction of the address with the nonce.
+func pendingWithNonce(address string, nonce uint64) (string, bool) {
+	var res string
+	memPool.Range(func(id string, t Transaction) bool {
+		if t.From == address && t.Nonce == nonce {
+			res = id
+			return false
+		}
+		return true
+	})
+	return res, res != ""
+}
+
+// evictStale removes the mempool transactions whose nonce has already been used, they can never be mined.
+func evictStale() {
+	memPool.Range(func(id string, t Transaction) bool {
+		if t.Nonce < NextNonce(t.From) {
+			memPool.Delete(id)
+		}
+		return true
+	})
+}
+
 func Get(hash string) (Transaction, bool) {
 	return memPool.Load(hash)
 }
 
 func Balance(address string) Coin {
 	amounts, _ := wallets.Load(address)
-	var balance Coin
+	// each amount is within MaxMoney and so is every intermediate balance
+	var balance int64
 	for _, a := range amounts {
-		if a >= 0 {
-			balance += Coin(a)
-		} else {
-			balance -= Coin(-a)
+		balance += a
+	}
+	if balance < 0 {
+		return 0
+	}
+	return Coin(balance)
+}
+
+// ConfirmedBalance is the balance counting only the blocks with at least the number of confirmations.
+// The tip has one confirmation, so with confirmations <= 1 it's the same as Balance.
+func ConfirmedBalance(address string, confirmations int) Coin {
+	// a block connected in between would be counted in the balance but not reverted.
+	blockchainLock.Lock()
+	defer blockchainLock.Unlock()
+	balance := Balance(address)
+	// blocks at the height and above have fewer confirmations, their effect is reverted.
+	from := max(blockchain.Len()-max(confirmations, 1)+1, 1)
+	var in, out Coin
+	for _, b := range blockchain.LoadRangeSafe(from, blockchain.Len()) {
+		for i, t := range b.Transactions {
+			for _, tf := range t.Transfers {
+				if tf.To == address {
+					in += tf.Amount
+				}
+				if i > 0 && t.From == address {
+					out += tf.Amount
+				}
+			}
+			if i > 0 && t.From == address {
+				out += t.Fee
+			}
 		}
 	}
-	return balance
+	return balance + out - in
+}
+
+// PendingAmounts sums what the address receives and sends with the mempool transactions, the fees included.
+// Transactions with used nonces are skipped.
+func PendingAmounts(address string) (incoming, outgoing Coin) {
+	memPool.Range(func(_ string, t Transaction) bool {
+		if t.Nonce < NextNonce(t.From) {
+			return true
+		}
+		for _, tf := range t.Transfers {
+			if tf.To == address {
+				incoming += tf.Amount
+			}
+			if t.From == address {
+				outgoing += tf.Amount
+			}
+		}
+		if t.From == address {
+			outgoing += t.Fee
+		}
+		return true
+	})
+	return incoming, outgoing
 }
 
+// NextNonce returns the nonce the next transaction from the address must have.
+func NextNonce(address string) uint64 {
+	n, _ := nonces.Load(address)
+	return n
+}
+
+// PendingNextNonce is NextNonce after the consecutive nonces of the address waiting in the mempool,
+// i.e. the nonce of the next transaction a wallet sends.
+func PendingNextNonce(address string) uint64 {
+	pending := make(map[uint64]bool)
+	memPool.Range(func(id string, t Transaction) bool {
+		if t.From == address {
+			pending[t.Nonce] = true
+		}
+		return true
+	})
+	next := NextNonce(address)
+	for pending[next] {
+		next++
+	}
+	return next
+}
+
+// Top returns the transactions with the highest fee per byte first.
+// Only the transactions which can be mined right away are returned,
+// i.e. transactions of each sender go in the nonce order without gaps. Already used nonces are skipped.
 func Top(num int) []Transaction {
-	var res []Transaction
+	bySender := make(map[string][]Transaction)
 	memPool.Range(func(k string, v Transaction) bool {
-		if num == 0 {
-			return false
-		}
-		res = append(res, v)
-		num--
+		bySender[v.From] = append(bySender[v.From], v)
 		return true
 	})
+
+	// executable transactions of each sender in the nonce order
+	var queues [][]Transaction
+	for from, txs := range bySender {
+		slices.SortFunc(txs, func(a, b Transaction) int {
+			return cmp.Compare(a.Nonce, b.Nonce)
+		})
+		next := NextNonce(from)
+		var queue []Transaction
+		for _, tx := range txs {
+			if tx.Nonce < next {
+				continue
+			}
+			if tx.Nonce != next {
+				break
+			}
+			queue = append(queue, tx)
+			next++
+		}
+		if len(queue) > 0 {
+			queues = append(queues, queue)
+		}
+	}
+
+	var res []Transaction
+	for len(res) < num && len(queues) > 0 {
+		// a sender's transaction can only be picked after its previous nonce
+		best := 0
+		for i, q := range queues {
+			if q[0].FeePerByte() > queues[best][0].FeePerByte() {
+				best = i
+			}
+		}
+		res = append(res, queues[best][0])
+		queues[best] = queues[best][1:]
+		if len(queues[best]) == 0 {
+			queues = slices.Delete(queues, best, best+1)
+		}
+	}
 	return res
 }
 
-func markIngested(ts []Transaction) {
+// TotalFee is what the miner of the transactions collects on top of the block reward.
+func TotalFee(ts []Transaction) (Coin, error) {
+	var fee Coin
 	for _, t := range ts {
-		memPool.Delete(t.ID)
-		var transferSum Coin
+		var err error
+		fee, err = fee.Add(t.Fee)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return fee, nil
+}
+
+// ts[0] is the coinbase transaction, its coins are minted, not withdrawn, and it doesn't use a nonce.
+func markIngested(ts []Transaction) {
+	for i, t := range ts {
+		memPool.Delete(t.ID())
+		transferSum := t.Fee
 		for _, tf := range t.Transfers {
 			deposit(tf.To, tf.Amount)
 			transferSum += tf.Amount
 		}
-		withdraw(t.From, transferSum)
+		if i > 0 {
+			withdraw(t.From, transferSum)
+			nonces.Store(t.From, t.Nonce+1)
+		}
 	}
+	// other transactions with the mined nonces
+	evictStale()
 }
 
+// amounts of the verified transactions are at most MaxMoney, they always fit into int64.
 func deposit(addr string, amount Coin) {
 	amounts, _ := wallets.Load(addr)
 	wallets.Store(addr, append(amounts, int64(amount)))
@@ -90,19 +334,28 @@ func deposit(addr string, amount Coin) {
 
 func withdraw(addr string, amount Coin) {
 	amounts, _ := wallets.Load(addr)
-	wallets.Store(addr, append(amounts, -int64(amount))) // fixme conversion
+	wallets.Store(addr, append(amounts, -int64(amount)))
 }
 
 // In case a block gets reverted by a longer chain.
 func markEgested(ts []Transaction) {
-	for _, t := range ts {
-		var transferSum Coin
+	// reverse order, so that the nonce of a sender ends up at its first transaction in the block.
+	for i := len(ts) - 1; i >= 0; i-- {
+		t := ts[i]
+		transferSum := t.Fee
 		for _, tf := range t.Transfers {
 			withdraw(tf.To, tf.Amount)
 			transferSum += tf.Amount
 		}
-		deposit(t.From, transferSum)
-
-		memPool.Store(t.ID, t)
+		if i > 0 {
+			deposit(t.From, transferSum)
+			nonces.Store(t.From, t.Nonce)
+			// the reverted transaction takes its nonce back from a pending one
+			if id, ok := pendingWithNonce(t.From, t.Nonce); ok {
+				memPool.Delete(id)
+			}
+			memPool.Store(t.ID(), t)
+		}
 	}
+	unindexAddresses(ts)
 }
@@ -0,0 +1,352 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransactionReplay(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	bob := mustPrivKey().PublicKey().Address(network)
+
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := NewTransactionS(bob, 10).Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(tx); err != nil {
+		t.Fatal(err)
+	}
+	b2 := mineEasyBlock(t, b1, Top(10)...)
+	if err := Broadcast(b2); err != nil {
+		t.Fatal(err)
+	}
+	if NextNonce(alice.PublicKey().Address(network)) != 1 {
+		t.Errorf("expected next nonce 1, got=%d", NextNonce(alice.PublicKey().Address(network)))
+	}
+
+	if err := Push(tx); err == nil {
+		t.Error("mined transaction shouldn't be accepted again")
+	}
+	b3 := mineEasyBlock(t, b2, tx)
+	if err := Broadcast(b3); err == nil {
+		t.Error("block with a replayed transaction shouldn't be accepted")
+	}
+}
+
+func TestTopNonceOrder(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, nonce := range []uint64{2, 1, 0, 4} {
+		tx := NewTransactionS(mustPrivKey().PublicKey().Address(network), 1)
+		tx.Nonce = nonce
+		tx, err := tx.Sign(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Push(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	top := Top(10)
+	if len(top) != 3 {
+		t.Fatalf("transaction with nonce gap shouldn't be selected, got=%d", len(top))
+	}
+	for i, tx := range top {
+		if tx.Nonce != uint64(i) {
+			t.Errorf("expected nonce %d, got=%d", i, tx.Nonce)
+		}
+	}
+}
+
+func TestTopFeeOrder(t *testing.T) {
+	resetBlockchain(t)
+	alice, bob := mustPrivKey(), mustPrivKey()
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	b2 := mineEasyBlockPaying(t, b1, bob.PublicKey().Address(network))
+	if err := Broadcast(b2); err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(pk *PrivateKey, nonce uint64, fee Coin) {
+		tx := NewTransactionS(mustPrivKey().PublicKey().Address(network), 1)
+		tx.Nonce = nonce
+		tx.Fee = fee
+		tx, err := tx.Sign(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Push(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	push(alice, 0, 100)
+	push(alice, 1, 100_000) // can't jump ahead of alice's first transaction
+	push(bob, 0, 10_000)
+
+	top := Top(10)
+	if len(top) != 3 {
+		t.Fatalf("expected 3 transactions, got=%d", len(top))
+	}
+	expectedFees := []Coin{10_000, 100, 100_000}
+	for i, tx := range top {
+		if tx.Fee != expectedFees[i] {
+			t.Errorf("index %d: expected fee %d, got=%d", i, expectedFees[i], tx.Fee)
+		}
+	}
+
+	// the miner collects the fees
+	minerKey := mustPrivKey()
+	miner := minerKey.PublicKey().Address(network)
+	fees, err := TotalFee(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := signedCoinbase(t, b2, miner, GetMinerReward()+fees+1, minerKey)
+	greedy := mine(NewBlock(b2.Hash(), append([]Transaction{coinbase}, top...), GetDiffuctlyTargetBits()))
+	if err := Broadcast(greedy); err == nil {
+		t.Error("coinbase shouldn't claim more than reward plus fees")
+	}
+	coinbase = signedCoinbase(t, b2, miner, GetMinerReward()+fees, minerKey)
+	b3 := mine(NewBlock(b2.Hash(), append([]Transaction{coinbase}, top...), GetDiffuctlyTargetBits()))
+	if err := Broadcast(b3); err != nil {
+		t.Fatal(err)
+	}
+	if Balance(miner) != GetMinerReward()+110_100 {
+		t.Errorf("miner didn't collect the fees, balance=%d", Balance(miner))
+	}
+}
+
+func TestConfirmedAndPendingBalance(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	aliceAddr := alice.PublicKey().Address(network)
+	bob := mustPrivKey().PublicKey().Address(network)
+
+	b1 := mineEasyBlockPaying(t, genesisBlock, aliceAddr)
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	reward := b1.Transactions[0].Transfers[0].Amount
+	tx := NewTransactionS(bob, 10)
+	tx.Fee = 1
+	tx, err := tx.Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2 := mineEasyBlock(t, b1, tx)
+	if err := Broadcast(b2); err != nil {
+		t.Fatal(err)
+	}
+	b3 := mineEasyBlock(t, b2)
+	if err := Broadcast(b3); err != nil {
+		t.Fatal(err)
+	}
+
+	for confirmations, expected := range map[int]Coin{0: 10, 1: 10, 2: 10, 3: 0, 100: 0} {
+		if got := ConfirmedBalance(bob, confirmations); got != expected {
+			t.Errorf("bob's balance at %d confirmations, expected=%d, got=%d", confirmations, expected, got)
+		}
+	}
+	if got := ConfirmedBalance(aliceAddr, 2); got != reward-11 {
+		t.Errorf("alice's balance at 2 confirmations: %d", got)
+	}
+	if got := ConfirmedBalance(aliceAddr, 3); got != reward {
+		t.Errorf("alice's balance at 3 confirmations: %d", got)
+	}
+
+	pending := NewTransactionS(bob, 5)
+	pending.Fee = 2
+	pending.Nonce = 1
+	pending, err = pending.Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(pending); err != nil {
+		t.Fatal(err)
+	}
+	if in, out := PendingAmounts(bob); in != 5 || out != 0 {
+		t.Errorf("bob's pending amounts: in=%d, out=%d", in, out)
+	}
+	if in, out := PendingAmounts(aliceAddr); in != 0 || out != 7 {
+		t.Errorf("alice's pending amounts: in=%d, out=%d", in, out)
+	}
+}
+
+func TestPendingDoubleSpend(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	balance := b1.Transactions[0].Transfers[0].Amount
+	spend := func(nonce uint64, amount Coin) Transaction {
+		tx := NewTransactionS(mustPrivKey().PublicKey().Address(network), amount)
+		tx.Nonce = nonce
+		tx, err := tx.Sign(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	// each one is covered by the balance, both together aren't
+	first, second := spend(0, balance/2+1), spend(1, balance/2+1)
+	if err := Push(first); err != nil {
+		t.Fatal(err)
+	}
+	err := Push(second)
+	var insufficient *InsufficientFundsError
+	if !errors.As(err, &insufficient) {
+		t.Fatalf("expected insufficient funds error, got=%v", err)
+	}
+	if firstAmount, _ := first.fullAmount(); insufficient.Pending != firstAmount || insufficient.Balance != balance {
+		t.Errorf("unexpected error: %+v", insufficient)
+	}
+
+	// the same combination in a block
+	b2 := mineEasyBlock(t, b1, first, second)
+	if err := Broadcast(b2); !errors.As(err, &insufficient) {
+		t.Fatalf("block overdrawing an account must be rejected, got=%v", err)
+	}
+	b2 = mineEasyBlock(t, b1, first, spend(1, balance/2-1))
+	if err := Broadcast(b2); err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction with a used nonce can't be mined, it mustn't lock the funds
+	b3 := mineEasyBlockPaying(t, b2, alice.PublicKey().Address(network))
+	if err := Broadcast(b3); err != nil {
+		t.Fatal(err)
+	}
+	stale := spend(1, balance/2)
+	memPool.Store(stale.ID(), stale)
+	if _, out := PendingAmounts(alice.PublicKey().Address(network)); out != 0 {
+		t.Errorf("stale transaction counted as pending: %d", out)
+	}
+	rest := Balance(alice.PublicKey().Address(network))
+	if err := Push(spend(2, rest)); err != nil {
+		t.Errorf("stale transaction mustn't reduce the spendable balance: %s", err)
+	}
+}
+
+func TestExtraNonceOnlyInCoinbase(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransactionS(mustPrivKey().PublicKey().Address(network), 1).Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.ExtraNonce = []byte{1}
+	if err := Push(tx); err == nil {
+		t.Error("transaction with an extra nonce must be rejected")
+	}
+
+	cb := signedCoinbase(t, b1, alice.PublicKey().Address(network), GetMinerReward(), alice)
+	cb.ExtraNonce = CoinbaseExtraNonce(2, make([]byte, MaxExtraNonceSize-3))
+	b := NewBlock(b1.Hash(), []Transaction{cb}, GetDiffuctlyTargetBits())
+	b.Timestamp = b1.Timestamp + 1
+	if err := Broadcast(mine(b)); err == nil {
+		t.Error("coinbase with a too long extra nonce must be rejected")
+	}
+	cb.ExtraNonce = cb.ExtraNonce[:MaxExtraNonceSize]
+	b = NewBlock(b1.Hash(), []Transaction{cb}, GetDiffuctlyTargetBits())
+	b.Timestamp = b1.Timestamp + 1
+	if err := Broadcast(mine(b)); err != nil {
+		t.Error("coinbase with an extra nonce must be accepted: ", err)
+	}
+}
+
+func TestMinedNonceEvictsPending(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	payWithNonce := func(nonce uint64, amount Coin) Transaction {
+		tx := NewTransactionS(mustPrivKey().PublicKey().Address(network), amount)
+		tx.Nonce = nonce
+		tx, err := tx.Sign(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	pending := payWithNonce(0, 1)
+	if err := Push(pending); err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(payWithNonce(0, 2)); err == nil {
+		t.Error("second transaction with a pending nonce must be rejected")
+	}
+
+	// another transaction with the same nonce gets mined, e.g. it came from another node
+	b2 := mineEasyBlock(t, b1, payWithNonce(0, 3))
+	if err := Broadcast(b2); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Get(pending.ID()); ok {
+		t.Error("transaction with the mined nonce must be evicted")
+	}
+	next := payWithNonce(1, 1)
+	if err := Push(next); err != nil {
+		t.Fatal(err)
+	}
+	if top := Top(10); len(top) != 1 || top[0].ID() != next.ID() {
+		t.Fatalf("expected the next nonce to be selected, got=%d", len(top))
+	}
+
+	// a stale transaction slipped in, it's skipped rather than blocking the sender
+	memPool.Store(pending.ID(), pending)
+	if top := Top(10); len(top) != 1 || top[0].ID() != next.ID() {
+		t.Errorf("stale transaction must be skipped, got=%d", len(top))
+	}
+}
+
+func TestPendingNextNonce(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	address := alice.PublicKey().Address(network)
+	b1 := mineEasyBlockPaying(t, genesisBlock, address)
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	push := func(nonce uint64) {
+		tx := NewTransactionS(mustPrivKey().PublicKey().Address(network), 1)
+		tx.Nonce = nonce
+		tx, err := tx.Sign(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Push(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	push(0)
+	push(1)
+	// a gap, the wallet must fill nonce 2 first
+	push(3)
+	if NextNonce(address) != 0 || PendingNextNonce(address) != 2 {
+		t.Errorf("expected confirmed nonce 0 and pending 2, got=%d, %d", NextNonce(address), PendingNextNonce(address))
+	}
+}
@@ -0,0 +1,141 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// MerkleProof proves that a transaction is in a block, given only the block header.
+// Light wallets check the header's proof-of-work and recompute its MerkleRoot from the txid and the branch.
+type MerkleProof struct {
+	// Block.Header
+	Header []byte
+	Height int
+	// position of the transaction in the block, its bits tell on which side the sibling is on each level.
+	Index int
+	// sibling hashes from the leaf up to the root
+	Branch [][]byte
+}
+
+func txHashes(ts []Transaction) [][]byte {
+	hashes := make([][]byte, len(ts))
+	for i, t := range ts {
+		hashes[i] = t.DoubleSha256()
+	}
+	return hashes
+}
+
+// The merkle tree is Bitcoin's: leaves are txids, every level hashes pairs of the level below,
+// the odd last hash of a level is paired with itself.
+// Because of that pairing, [a b c] and [a b c c] have the same root (CVE-2012-2459).
+// A peer could send the mutated list under the header of a valid block,
+// that's why blocks with duplicate transactions are rejected, see verifyMerkleRoot.
+// With unique leaves, two equal hashes on any level would need a SHA-256 collision.
+
+func calcMerkelRoot(ts []Transaction) []byte {
+	return merkleRoot(txHashes(ts))
+}
+
+func merkleRoot(hashes [][]byte) []byte {
+	switch len(hashes) {
+	case 0:
+		// like an empty MerkleRoot in the header
+		return make([]byte, 32)
+	case 1:
+		return hashes[0]
+	}
+	level := hashes
+	for len(level) > 1 {
+		level = nextMerkleLevel(level)
+	}
+	return level[0]
+}
+
+func nextMerkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		next = append(next, doubleSHA256(append(bytes.Clone(level[i]), right...)))
+	}
+	return next
+}
+
+// merkleBranch returns the siblings of the leaf at the index, from the leaf up.
+func merkleBranch(leaves [][]byte, index int) [][]byte {
+	var branch [][]byte
+	for len(leaves) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(leaves) {
+			sibling = index
+		}
+		branch = append(branch, leaves[sibling])
+		leaves = nextMerkleLevel(leaves)
+		index /= 2
+	}
+	return branch
+}
+
+// verifyMerkleRoot checks the block's transactions are unique and match the MerkleRoot of the header.
+func verifyMerkleRoot(b Block) error {
+	seen := make(map[string]bool, len(b.Transactions))
+	for _, tx := range b.Transactions {
+		id := tx.ID()
+		if seen[id] {
+			return fmt.Errorf("duplicate transaction in block, tx_id=%s", id)
+		}
+		seen[id] = true
+	}
+	if !bytes.Equal(b.MerkleRoot, calcMerkelRoot(b.Transactions)) {
+		return fmt.Errorf("merkle root doesn't match the transactions")
+	}
+	return nil
+}
+
+// VerifyMerkleProof checks that the transaction hash at the index leads to the merkle root through the branch.
+func VerifyMerkleProof(txHash []byte, index int, branch [][]byte, root []byte) bool {
+	if index < 0 {
+		return false
+	}
+	h := txHash
+	for _, sibling := range branch {
+		if index%2 == 0 {
+			h = doubleSHA256(append(bytes.Clone(h), sibling...))
+		} else {
+			h = doubleSHA256(append(bytes.Clone(sibling), h...))
+		}
+		index /= 2
+	}
+	// an index beyond the branch would mean a bigger tree
+	return index == 0 && bytes.Equal(h, root)
+}
+
+// Verify checks the proof against its own header, the caller must check that the header is in the best chain.
+func (p MerkleProof) Verify(txID string) bool {
+	b, err := ParseBlockHeader(p.Header)
+	if err != nil {
+		return false
+	}
+	txHash, err := hex.DecodeString(txID)
+	if err != nil {
+		return false
+	}
+	return VerifyMerkleProof(txHash, p.Index, p.Branch, b.MerkleRoot)
+}
+
+// ProveTransaction builds the merkle proof of a confirmed transaction.
+func ProveTransaction(txID string) (MerkleProof, bool) {
+	b, loc, ok := findConfirmed(txID)
+	if !ok {
+		return MerkleProof{}, false
+	}
+	return MerkleProof{
+		Header: b.Header(),
+		Height: loc.Height,
+		Index:  loc.Index,
+		Branch: merkleBranch(txHashes(b.Transactions), loc.Index),
+	}, true
+}
@@ -0,0 +1,171 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"slices"
+	"testing"
+	"testing/quick"
+)
+
+// referenceMerkleRoot is the textbook definition of Bitcoin's merkle root, written as plainly as possible.
+func referenceMerkleRoot(hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		return make([]byte, 32)
+	}
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+	if len(hashes)%2 == 1 {
+		hashes = append(hashes, hashes[len(hashes)-1])
+	}
+	var parents [][]byte
+	for i := 0; i < len(hashes); i += 2 {
+		var concat []byte
+		concat = append(concat, hashes[i]...)
+		concat = append(concat, hashes[i+1]...)
+		parents = append(parents, doubleSHA256(concat))
+	}
+	return referenceMerkleRoot(parents)
+}
+
+func toHashes(leaves [][32]byte) [][]byte {
+	var hashes [][]byte
+	for _, l := range leaves {
+		hashes = append(hashes, bytes.Clone(l[:]))
+	}
+	return hashes
+}
+
+var quickConfig = &quick.Config{MaxCount: 300}
+
+func TestMerkleRootMatchesReference(t *testing.T) {
+	f := func(leaves [][32]byte) bool {
+		hashes := toHashes(leaves)
+		return bytes.Equal(merkleRoot(hashes), referenceMerkleRoot(hashes))
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMerkleBranchProperty(t *testing.T) {
+	f := func(leaves [][32]byte, pick uint16) bool {
+		if len(leaves) == 0 {
+			return true
+		}
+		hashes := toHashes(leaves)
+		root := referenceMerkleRoot(hashes)
+		i := int(pick) % len(hashes)
+		branch := merkleBranch(hashes, i)
+		if !VerifyMerkleProof(hashes[i], i, branch, root) {
+			return false
+		}
+		// a proof doesn't hold for another leaf or another position
+		if VerifyMerkleProof(doubleSHA256(hashes[i]), i, branch, root) {
+			return false
+		}
+		j := (i + 1) % len(hashes)
+		return j == i || bytes.Equal(hashes[i], hashes[j]) || !VerifyMerkleProof(hashes[i], j, branch, root)
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// the duplicate-leaf mutation keeps the root, which is why verifyMerkleRoot rejects duplicates.
+func TestMerkleDuplicateLeafMutation(t *testing.T) {
+	f := func(leaves [][32]byte) bool {
+		hashes := toHashes(leaves)
+		if len(hashes) < 3 || len(hashes)%2 == 0 {
+			return true
+		}
+		mutated := append(hashes, hashes[len(hashes)-1])
+		return bytes.Equal(merkleRoot(hashes), merkleRoot(mutated))
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMerkleRootEdgeCases(t *testing.T) {
+	if !bytes.Equal(merkleRoot(nil), make([]byte, 32)) {
+		t.Error("root of no transactions must be zeros")
+	}
+	h := doubleSHA256([]byte{1})
+	if !bytes.Equal(merkleRoot([][]byte{h}), h) {
+		t.Error("root of a single transaction must be its txid")
+	}
+	if len(merkleBranch([][]byte{h}, 0)) != 0 || !VerifyMerkleProof(h, 0, nil, h) {
+		t.Error("single transaction must have an empty branch")
+	}
+}
+
+func TestVerifyMerkleRootRejectsDuplicates(t *testing.T) {
+	var txs []Transaction
+	for i := 0; i < 3; i++ {
+		tx, err := NewTransactionS(mustPrivKey().PublicKey().Address(network), 1).Sign(mustPrivKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	b := NewBlock(genesisBlock.Hash(), txs, GetDiffuctlyTargetBits())
+	if err := verifyMerkleRoot(b); err != nil {
+		t.Fatal(err)
+	}
+	mutated := b
+	mutated.Transactions = append(slices.Clone(txs), txs[2])
+	if !mutated.Equals(b) {
+		t.Fatal("mutated block must have the same header")
+	}
+	if err := verifyMerkleRoot(mutated); err == nil {
+		t.Error("block with a duplicate transaction must be rejected")
+	}
+	mutated.Transactions = txs[:2]
+	if err := verifyMerkleRoot(mutated); err == nil {
+		t.Error("block with other transactions must be rejected")
+	}
+}
+
+func TestProveTransaction(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	var txs []Transaction
+	for i := uint64(0); i < 3; i++ {
+		tx := NewTransactionS(mustPrivKey().PublicKey().Address(network), 10)
+		tx.Nonce = i
+		tx, err := tx.Sign(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	b2 := mineEasyBlock(t, b1, txs...)
+	if err := Broadcast(b2); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tx := range b2.Transactions {
+		p, ok := ProveTransaction(tx.ID())
+		if !ok {
+			t.Fatalf("transaction %d not found", i)
+		}
+		if p.Height != 2 || p.Index != i || !bytes.Equal(p.Header, b2.Header()) {
+			t.Errorf("unexpected proof: %+v", p)
+		}
+		if !p.Verify(tx.ID()) {
+			t.Errorf("proof of transaction %d failed", i)
+		}
+		if p.Verify(txs[(i+1)%len(txs)].ID()) {
+			t.Errorf("proof of transaction %d verified another transaction", i)
+		}
+	}
+	if _, ok := ProveTransaction(hex.EncodeToString(doubleSHA256([]byte("unknown")))); ok {
+		t.Error("unknown transaction must not be found")
+	}
+}
@@ -0,0 +1,144 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/glossd/viatcoin/chain/util"
+)
+
+// BlockTemplate is everything a miner needs for the next block in one consistent view, like Bitcoin's getblocktemplate.
+// The miner adds its coinbase transaction, see BlockTemplate.NewBlock, and submits the solved block with the template ID.
+type BlockTemplate struct {
+	// identifies the contents of the template, a new tip or other transactions give a new ID.
+	ID           string
+	PreviousHash []byte
+	Height       int
+	Bits         uint32
+	// the block reward without the fees
+	Reward Coin
+	// the fees of Transactions, the coinbase may claim Reward plus Fees
+	Fees Coin
+	// the block's timestamp must be at least it, see medianTimePast
+	MinTimestamp uint32
+	// selected from the mempool, the coinbase goes before them
+	Transactions []Transaction
+	// the merkle branch of the coinbase, it doesn't depend on the coinbase itself,
+	// so the miner can compute the merkle root of any coinbase with it.
+	CoinbaseBranch [][]byte
+}
+
+// BlockSubmission is a block solved from a template.
+type BlockSubmission struct {
+	TemplateID string
+	Block      Block
+}
+
+const maxTemplateTxs = 1000
+
+// ErrStaleTemplate is returned for a template of an old tip or the one the node never handed out.
+var ErrStaleTemplate = errors.New("stale template")
+
+// the miners submit the recent templates, the older ones are dropped
+const maxTemplates = 16
+
+// templates handed out for the current tip by ID, the oldest first.
+var templates = util.SortedMap[string, BlockTemplate]{}
+
+// NewBlockTemplate builds the template of the next block on top of the tip.
+func NewBlockTemplate() (BlockTemplate, error) {
+	blockchainLock.Lock()
+	defer blockchainLock.Unlock()
+
+	last := blockchain.Last()
+	height := blockchain.Len()
+	txs := Top(maxTemplateTxs)
+	fees, err := TotalFee(txs)
+	if err != nil {
+		return BlockTemplate{}, err
+	}
+	t := BlockTemplate{
+		PreviousHash:   last.Hash(),
+		Height:         height,
+		Bits:           nextWorkRequired(height, blockchain.LoadIndex),
+		Reward:         GetMinerReward(),
+		Fees:           fees,
+		MinTimestamp:   medianTimePast(height, blockchain.LoadIndex) + 1,
+		Transactions:   txs,
+		CoinbaseBranch: merkleBranch(append([][]byte{nil}, txHashes(txs)...), 0),
+	}
+	t.ID = t.contentID()
+
+	storeTemplate(t)
+	return t, nil
+}
+
+// storeTemplate keeps the last maxTemplates of the tip, the one handed out again becomes the newest.
+func storeTemplate(t BlockTemplate) {
+	// templates of the old tips can't be submitted anyway
+	if templates.Len() > 0 && !bytes.Equal(templates.LoadIndex(0).PreviousHash, t.PreviousHash) {
+		templates.Clear()
+	}
+	if _, ok := templates.Load(t.ID); ok {
+		templates.Delete(t.ID)
+	}
+	templates.Store(t.ID, t)
+	if n := templates.Len(); n > maxTemplates {
+		templates.DeleteIndex(0, n-maxTemplates)
+	}
+}
+
+func (t BlockTemplate) contentID() string {
+	var buf bytes.Buffer
+	buf.Write(t.PreviousHash)
+	buf.Write(binary.LittleEndian.AppendUint32(nil, t.Bits))
+	for _, tx := range t.Transactions {
+		buf.Write(tx.DoubleSha256())
+	}
+	return hex.EncodeToString(doubleSHA256(buf.Bytes()))
+}
+
+// MerkleRoot of the template's transactions with the coinbase first.
+func (t BlockTemplate) MerkleRoot(coinbase Transaction) []byte {
+	h := coinbase.DoubleSha256()
+	for _, sibling := range t.CoinbaseBranch {
+		h = doubleSHA256(append(bytes.Clone(h), sibling...))
+	}
+	return h
+}
+
+// NewBlock assembles the block of the template, only the nonce is left to find.
+func (t BlockTemplate) NewBlock(coinbase Transaction) Block {
+	return Block{
+		PreviousHash:         t.PreviousHash,
+		MerkleRoot:           t.MerkleRoot(coinbase),
+		Timestamp:            max(uint32(time.Now().Unix()), t.MinTimestamp),
+		DifficultyTargetBits: t.Bits,
+		Transactions:         append([]Transaction{coinbase}, t.Transactions...),
+	}
+}
+
+// SubmitBlock checks the block was built from the template and broadcasts it.
+func SubmitBlock(s BlockSubmission) error {
+	t, ok := templates.Load(s.TemplateID)
+	if !ok || !bytes.Equal(t.PreviousHash, blockchain.Last().Hash()) {
+		return fmt.Errorf("%w: id=%s", ErrStaleTemplate, s.TemplateID)
+	}
+	b := s.Block
+	if !bytes.Equal(b.PreviousHash, t.PreviousHash) || b.DifficultyTargetBits != t.Bits {
+		return fmt.Errorf("block doesn't match the template")
+	}
+	if len(b.Transactions) != len(t.Transactions)+1 {
+		return fmt.Errorf("block must have the coinbase and the template's transactions")
+	}
+	for i, tx := range t.Transactions {
+		if b.Transactions[i+1].ID() != tx.ID() {
+			return fmt.Errorf("transaction %d doesn't match the template", i+1)
+		}
+	}
+	return Broadcast(b)
+}
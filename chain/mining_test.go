@@ -0,0 +1,104 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBlockTemplate(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	bob := mustPrivKey().PublicKey().Address(network)
+
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		tx := NewTransactionS(bob, 10)
+		tx.Fee = 5
+		tx.Nonce = uint64(i)
+		tx, err := tx.Sign(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Push(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tmpl, err := NewBlockTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.Height != 2 || !bytes.Equal(tmpl.PreviousHash, b1.Hash()) || len(tmpl.Transactions) != 3 || tmpl.Fees != 15 {
+		t.Fatalf("unexpected template: %+v", tmpl)
+	}
+	if same, _ := NewBlockTemplate(); same.ID != tmpl.ID {
+		t.Error("the same tip and transactions must give the same ID")
+	}
+
+	cb := signedCoinbase(t, b1, bob, tmpl.Reward+tmpl.Fees, mustPrivKey())
+	b := tmpl.NewBlock(cb)
+	if !bytes.Equal(b.MerkleRoot, calcMerkelRoot(b.Transactions)) {
+		t.Fatal("merkle root of the coinbase branch differs")
+	}
+	b = mine(b)
+
+	if err := SubmitBlock(BlockSubmission{TemplateID: "unknown", Block: b}); !errors.Is(err, ErrStaleTemplate) {
+		t.Errorf("expected stale template error, got %v", err)
+	}
+	missing := b
+	missing.Transactions = b.Transactions[:3]
+	if err := SubmitBlock(BlockSubmission{TemplateID: tmpl.ID, Block: missing}); err == nil {
+		t.Error("block without the template's transactions must be rejected")
+	}
+	if err := SubmitBlock(BlockSubmission{TemplateID: tmpl.ID, Block: b}); err != nil {
+		t.Fatal(err)
+	}
+	if !blockchain.Last().Equals(b) {
+		t.Fatal("submitted block isn't the tip")
+	}
+	if err := SubmitBlock(BlockSubmission{TemplateID: tmpl.ID, Block: b}); !errors.Is(err, ErrStaleTemplate) {
+		t.Errorf("template of the old tip must be stale, got %v", err)
+	}
+}
+
+func TestTemplatesCapped(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	bob := mustPrivKey().PublicKey().Address(network)
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+
+	// each pushed transaction changes the template of the same tip
+	var ids []string
+	for i := 0; i < maxTemplates+5; i++ {
+		tx := NewTransactionS(bob, 1)
+		tx.Nonce = uint64(i)
+		tx, err := tx.Sign(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Push(tx); err != nil {
+			t.Fatal(err)
+		}
+		tmpl, err := NewBlockTemplate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, tmpl.ID)
+	}
+	if templates.Len() != maxTemplates {
+		t.Fatalf("expected %d templates, got %d", maxTemplates, templates.Len())
+	}
+	if _, ok := templates.Load(ids[0]); ok {
+		t.Error("the oldest template must be dropped")
+	}
+	if _, ok := templates.Load(ids[len(ids)-1]); !ok {
+		t.Error("the newest template must be kept")
+	}
+}
@@ -2,11 +2,13 @@ package chain
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/glossd/viatcoin/chain/util"
 	"math"
 	"math/big"
 	"sync"
+	"time"
 )
 
 type Net byte
@@ -14,19 +16,46 @@ type Net byte
 const (
 	Mainnet Net = 0x00
 	Testnet Net = 0x6F
+	// Regtest is a local network with a trivial difficulty which never adjusts, meant for tests.
+	Regtest Net = 0x7F
 )
 
 var network = Mainnet
 
+type netParams struct {
+	// the retarget keeps the average time between blocks around it
+	TargetBlockInterval time.Duration
+	// the difficulty is adjusted every RetargetWindow blocks
+	RetargetWindow int
+	// every block has the genesis difficulty, the lowest one
+	NoRetarget bool
+}
+
+var netParamsByNet = map[Net]netParams{
+	// adjust mining difficulty every 2,016 blocks (~2 weeks) to keep block times around 10 minutes.
+	Mainnet: {TargetBlockInterval: 10 * time.Minute, RetargetWindow: NumBlocksAdjust},
+	Testnet: {TargetBlockInterval: 10 * time.Minute, RetargetWindow: NumBlocksAdjust},
+	// blocks are mined on demand, as fast as the tests need them.
+	Regtest: {TargetBlockInterval: 10 * time.Minute, RetargetWindow: NumBlocksAdjust, NoRetarget: true},
+}
+
+// SetNetwork must be called before Run, it resets the blockchain to the genesis block of the network.
 func SetNetwork(net Net) {
+	blockchainLock.Lock()
+	defer blockchainLock.Unlock()
 	network = net
+	genesisBlock = newGenesisBlock(net)
+	blockchain.Clear()
+	blockchain.Store(genesisBlock.HashString(), genesisBlock)
+	txIndex.Clear()
+	indexTxs(genesisBlock, 0)
 }
 
-// adjust mining difficulty every 2,016 blocks (~2 weeks) to keep block times around 10 minutes.
-var difficulty = new(big.Float).SetFloat64(0.001)
-
 const NumBlocksAdjust = 2016
 
+// the adjustment factor of one retarget is clamped to it
+const maxRetargetFactor = 4
+
 const OriginalMinerReward = 50 * Viatcoin
 
 var blockchain = util.SortedMap[string, Block]{}
@@ -35,6 +64,12 @@ var blockchainLock sync.Mutex
 
 func init() {
 	blockchain.Store(genesisBlock.HashString(), genesisBlock)
+	indexTxs(genesisBlock, 0)
+}
+
+// GenesisBlock is the first block of the network set with SetNetwork.
+func GenesisBlock() Block {
+	return genesisBlock
 }
 
 func GetLastBlock() Block {
@@ -45,64 +80,165 @@ func GetMinerReward() Coin {
 	return OriginalMinerReward / Coin(math.Pow(2, float64(blockchain.Len()/210_000)))
 }
 
+// GetDiffuctlyTargetBits returns the bits the next block must have.
 func GetDiffuctlyTargetBits() uint32 {
-	return DiffucltyToBits(difficulty)
+	return nextWorkRequired(blockchain.Len(), blockchain.LoadIndex)
 }
 
 func GetTotalWork() *big.Int {
 	return TotalWork(blockchain.LoadRangeSafe(0, math.MaxInt))
 }
 
+// ErrStaleTip is returned for a block which doesn't follow the tip, usually another block was found first.
+var ErrStaleTip = errors.New("invalid previous hash")
+
+// Broadcast adds the block to the blockchain and announces it to the peers.
 func Broadcast(b Block) error {
-	return doBroadcast(b, difficulty, NumBlocksAdjust)
+	err := doBroadcast(b)
+	if err != nil {
+		return err
+	}
+	announce(invBlock, b.HashString())
+	return nil
+}
+
+func doBroadcast(b Block) error {
+	if err := verifyBlock(b); err != nil {
+		return err
+	}
+
+	blockchainLock.Lock()
+	defer blockchainLock.Unlock()
+	if !bytes.Equal(b.PreviousHash, blockchain.Last().Hash()) {
+		return fmt.Errorf("%w: blockchain changed", ErrStaleTip)
+	}
+
+	return persist(b)
 }
 
-func doBroadcast(b Block, diff *big.Float, numOfBlocksBeforeAdjust int) error {
+// verifyBlock checks the block can be put on top of the current blockchain.
+func verifyBlock(b Block) error {
+	if expected := GetDiffuctlyTargetBits(); b.DifficultyTargetBits != expected {
+		return fmt.Errorf("unexpected difficulty bits, expected=%x, got=%x", expected, b.DifficultyTargetBits)
+	}
 	if !b.Valid() {
 		return fmt.Errorf("invalid block")
 	}
 	if !bytes.Equal(b.PreviousHash, blockchain.Last().Hash()) {
-		return fmt.Errorf("invalid previous hash")
+		return ErrStaleTip
+	}
+	if err := verifyTimestamp(b, blockchain.Len(), blockchain.LoadIndex); err != nil {
+		return err
 	}
 
-	// todo check the timestamps
 	if len(b.Transactions) == 0 {
 		return fmt.Errorf("block must have at least one coinbase transaction")
 	}
+	if err := verifyMerkleRoot(b); err != nil {
+		return err
+	}
 
 	coinbase := b.Transactions[0]
 	if err := coinbase.Verify(); err != nil {
 		return fmt.Errorf("coinbase transaction is invalid: %s", err)
 	}
-	if len(coinbase.Transfers) != 1 || coinbase.Transfers[0].Amount != GetMinerReward() {
-		return fmt.Errorf("coinbase transfer amount doesn't match miner reward")
+	if len(coinbase.ExtraNonce) > MaxExtraNonceSize {
+		return fmt.Errorf("coinbase extra nonce exceeds %d bytes", MaxExtraNonceSize)
+	}
+	if height := blockchain.Len(); !bytes.HasPrefix(coinbase.ExtraNonce, CoinbaseExtraNonce(height, nil)) {
+		return fmt.Errorf("coinbase extra nonce must start with the block height=%d", height)
+	}
+	if coinbase.Fee != 0 {
+		return fmt.Errorf("coinbase transaction can't have a fee")
+	}
+	if len(coinbase.Transfers) != 1 {
+		return fmt.Errorf("coinbase transaction must have exactly one transfer")
+	}
+	claimed, err := coinbase.fullAmount()
+	if err != nil {
+		return fmt.Errorf("coinbase transaction is invalid: %s", err)
+	}
+	// the miner may claim the block reward plus the fees of the block's transactions.
+	fees, err := TotalFee(b.Transactions[1:])
+	if err != nil {
+		return err
+	}
+	allowed, err := GetMinerReward().Add(fees)
+	if err != nil {
+		return err
+	}
+	if claimed > allowed {
+		return fmt.Errorf("coinbase transfer amount exceeds miner reward plus fees")
 	}
 
+	nextNonces := make(map[string]uint64)
+	// what each sender has spent in the preceding transactions of the block
+	spent := make(map[string]Coin)
 	for _, tx := range b.Transactions[1:] {
-		if err := verifyTx(tx); err != nil {
-			return fmt.Errorf("invalid transaction tx_id='%s': %s", tx.ID, err)
+		if err := verifyTx(tx, spent[tx.From]); err != nil {
+			return fmt.Errorf("invalid transaction tx_id='%s': %w", tx.ID(), err)
 		}
+		next, ok := nextNonces[tx.From]
+		if !ok {
+			next = NextNonce(tx.From)
+		}
+		if tx.Nonce != next {
+			return fmt.Errorf("invalid transaction tx_id='%s': expected nonce=%d, got=%d", tx.ID(), next, tx.Nonce)
+		}
+		nextNonces[tx.From] = next + 1
+		// verifyTx made sure it's covered by the balance
+		full, _ := tx.fullAmount()
+		spent[tx.From] += full
 	}
+	return nil
+}
 
-	blockchainLock.Lock()
-	defer blockchainLock.Unlock()
-	if !bytes.Equal(b.PreviousHash, blockchain.Last().Hash()) {
-		return fmt.Errorf("invalid previous hash: blockchain changed")
+// nextWorkRequired returns the bits the block at the height must have, blockAt returns the preceding blocks.
+// Like Bitcoin's CalculateNextWorkRequired, it only depends on the headers and uses integer arithmetic,
+// so every node computes the same bits no matter when it joined.
+func nextWorkRequired(height int, blockAt func(height int) Block) uint32 {
+	params := netParamsByNet[network]
+	if height == 0 || params.NoRetarget {
+		return genesisBlock.DifficultyTargetBits
+	}
+	last := blockAt(height - 1)
+	if height%params.RetargetWindow != 0 {
+		return last.DifficultyTargetBits
 	}
 
-	persist(b)
+	first := blockAt(height - params.RetargetWindow)
+	expectedTimespan := int64(params.TargetBlockInterval/time.Second) * int64(params.RetargetWindow)
+	actualTimespan := int64(last.Timestamp) - int64(first.Timestamp)
+	actualTimespan = max(actualTimespan, expectedTimespan/maxRetargetFactor)
+	actualTimespan = min(actualTimespan, expectedTimespan*maxRetargetFactor)
+
+	// faster blocks than expected make the target lower, i.e. the difficulty higher.
+	target := bitsToTarget(last.DifficultyTargetBits)
+	target.Mul(target, big.NewInt(actualTimespan))
+	target.Div(target, big.NewInt(expectedTimespan))
+
+	// the genesis difficulty is the lowest one
+	powLimit := bitsToTarget(genesisBlock.DifficultyTargetBits)
+	if target.Cmp(powLimit) > 0 {
+		target = powLimit
+	}
+	return targetToBits(target)
+}
 
-	if blockchain.Len()%numOfBlocksBeforeAdjust == 0 { // genesis block is hard-coded not broadcasted
-		first := blockchain.LoadIndex(blockchain.Len() - numOfBlocksBeforeAdjust)
-		last := blockchain.Last()
-		actualTime := new(big.Float).SetInt64(int64(last.Timestamp - first.Timestamp))
-		expectedTime := new(big.Float).SetInt64(10 * 60 * int64(numOfBlocksBeforeAdjust))
-		diff.Mul(diff, new(big.Float).Quo(expectedTime, actualTime))
+// persist writes the block through to the store and then applies it in memory.
+func persist(b Block) error {
+	if store != nil {
+		if err := store.Append(b); err != nil {
+			return fmt.Errorf("failed to store block: %s", err)
+		}
 	}
+	connect(b)
 	return nil
 }
 
-func persist(b Block) {
+func connect(b Block) {
 	markIngested(b.Transactions)
+	indexAddresses(blockchain.Len(), b.Transactions)
+	indexTxs(b, blockchain.Len())
 	blockchain.Store(b.HashString(), b)
 }
@@ -0,0 +1,161 @@
+package chain
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ReorgEvent is emitted when the blockchain switches to a branch with more work.
+type ReorgEvent struct {
+	// height of the last block both branches share
+	ForkHeight int
+	// number of blocks orphaned from the old branch
+	Depth  int
+	OldTip string
+	NewTip string
+	// transactions of the orphaned blocks, the ones not included in the new branch are back in the mempool.
+	RevertedTxIDs []string
+	// transactions of the new branch's blocks
+	AppliedTxIDs []string
+}
+
+var reorgListeners []func(ReorgEvent)
+var reorgListenersLock sync.Mutex
+
+// OnReorg registers a function which is called after every reorganization.
+func OnReorg(f func(ReorgEvent)) {
+	reorgListenersLock.Lock()
+	defer reorgListenersLock.Unlock()
+	reorgListeners = append(reorgListeners, f)
+}
+
+func emitReorg(e ReorgEvent) {
+	log.Printf("reorganization: fork_height=%d, depth=%d, old_tip=%s, new_tip=%s", e.ForkHeight, e.Depth, e.OldTip, e.NewTip)
+	reorgListenersLock.Lock()
+	listeners := append([]func(ReorgEvent){}, reorgListeners...)
+	reorgListenersLock.Unlock()
+	for _, f := range listeners {
+		f(e)
+	}
+}
+
+// reorganize switches the blockchain to the branch, the first block of which must follow a block of our chain.
+// Orphaned blocks are rolled back and every block of the branch is validated like a broadcasted one.
+// If any block fails or the store can't be written, the old tip is restored in memory and in the store.
+// The listeners are called after the blockchain is unlocked, so they can use it.
+// The new tip is announced to the peers like a broadcasted block.
+func reorganize(branch []Block) error {
+	e, err := switchBranch(branch)
+	if err != nil || e == nil {
+		return err
+	}
+	emitReorg(*e)
+	announce(invBlock, e.NewTip)
+	return nil
+}
+
+// switchBranch returns no event if the branch is already in the blockchain.
+func switchBranch(branch []Block) (*ReorgEvent, error) {
+	if len(branch) == 0 {
+		return nil, nil
+	}
+	blockchainLock.Lock()
+	defer blockchainLock.Unlock()
+
+	forkHeight := blockchain.IndexOf(hex.EncodeToString(branch[0].PreviousHash))
+	if forkHeight == -1 {
+		return nil, fmt.Errorf("branch doesn't connect to the blockchain, previous_hash=%x", branch[0].PreviousHash)
+	}
+	// the branch may start with blocks we already have
+	for len(branch) > 0 && forkHeight+1 < blockchain.Len() && branch[0].Equals(blockchain.LoadIndex(forkHeight+1)) {
+		forkHeight++
+		branch = branch[1:]
+	}
+	if len(branch) == 0 {
+		return nil, nil
+	}
+
+	orphaned := blockchain.LoadRangeSafe(forkHeight+1, blockchain.Len())
+	if TotalWork(branch).Cmp(TotalWork(orphaned)) <= 0 {
+		return nil, fmt.Errorf("branch doesn't have more work than the blockchain after height=%d", forkHeight)
+	}
+	oldTip := blockchain.Last().HashString()
+	pending := memPool.AsMap()
+	// restore the old branch, its blocks were valid before.
+	rollback := func() {
+		disconnectAfter(forkHeight)
+		for _, o := range orphaned {
+			connect(o)
+		}
+		memPool.Clear()
+		for id, t := range pending {
+			memPool.Store(id, t)
+		}
+	}
+
+	disconnectAfter(forkHeight)
+	for i, b := range branch {
+		if err := verifyBlock(b); err != nil {
+			rollback()
+			return nil, fmt.Errorf("reorganization aborted, invalid block at height=%d, hash=%s: %s", forkHeight+1+i, b.HashString(), err)
+		}
+		connect(b)
+	}
+
+	if err := storeBranch(forkHeight, branch); err != nil {
+		rollback()
+		if err := storeBranch(forkHeight, orphaned); err != nil {
+			log.Printf("reorganization: failed to restore stored blocks: %s", err)
+		}
+		return nil, fmt.Errorf("reorganization aborted: %s", err)
+	}
+
+	return &ReorgEvent{
+		ForkHeight:    forkHeight,
+		Depth:         len(orphaned),
+		OldTip:        oldTip,
+		NewTip:        blockchain.Last().HashString(),
+		RevertedTxIDs: txIDs(orphaned),
+		AppliedTxIDs:  txIDs(branch),
+	}, nil
+}
+
+// storeBranch replaces the stored blocks after the fork height with the branch.
+func storeBranch(forkHeight int, branch []Block) error {
+	if store == nil {
+		return nil
+	}
+	if err := store.Truncate(forkHeight + 1); err != nil {
+		return fmt.Errorf("failed to revert stored blocks: %s", err)
+	}
+	for _, b := range branch {
+		if err := store.Append(b); err != nil {
+			return fmt.Errorf("failed to store block: %s", err)
+		}
+	}
+	return nil
+}
+
+// disconnectAfter rolls back all the blocks after the height, the tip first.
+func disconnectAfter(height int) {
+	for blockchain.Len()-1 > height {
+		last := blockchain.Len() - 1
+		b := blockchain.LoadIndex(last)
+		// In case a block gets reverted by a longer chain.
+		markEgested(b.Transactions)
+		unindexTxs(b)
+		blockchain.DeleteIndex(last, last+1)
+	}
+}
+
+func txIDs(blocks []Block) []string {
+	var ids []string
+	for _, b := range blocks {
+		for _, t := range b.Transactions {
+			ids = append(ids, t.ID())
+		}
+	}
+	return ids
+}
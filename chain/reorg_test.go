@@ -0,0 +1,179 @@
+package chain
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestReorganize(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	bob := mustPrivKey().PublicKey().Address(network)
+
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransactionS(bob, 10).Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2 := mineEasyBlock(t, b1, tx)
+	if err := Broadcast(a2); err != nil {
+		t.Fatal(err)
+	}
+	a3 := mineEasyBlock(t, a2)
+	if err := Broadcast(a3); err != nil {
+		t.Fatal(err)
+	}
+
+	// competing branch after b1 without alice's transaction
+	c2 := mineEasyBlock(t, b1)
+	c3 := mineEasyBlock(t, c2)
+	c4 := mineEasyBlock(t, c3)
+
+	var events []ReorgEvent
+	OnReorg(func(e ReorgEvent) {
+		// the listeners run outside of the blockchain lock
+		ConfirmedBalance(bob, 1)
+		events = append(events, e)
+	})
+	t.Cleanup(func() { reorgListeners = nil })
+
+	if err := reorganize([]Block{b1, c2, c3}); err == nil {
+		t.Error("branch with the same work shouldn't replace the blockchain")
+	}
+	// the branch can start with already known blocks
+	if err := reorganize([]Block{b1, c2, c3, c4}); err != nil {
+		t.Fatal(err)
+	}
+	if !GetLastBlock().Equals(c4) || blockchain.Len() != 5 {
+		t.Fatalf("expected to switch to the new branch, height=%d", blockchain.Len()-1)
+	}
+	if Balance(bob) != 0 {
+		t.Errorf("orphaned transaction should be reverted, bob's balance=%d", Balance(bob))
+	}
+	if _, ok := Get(tx.ID()); !ok {
+		t.Error("orphaned transaction should be back in the mempool")
+	}
+	if NextNonce(alice.PublicKey().Address(network)) != 0 {
+		t.Error("alice's nonce should be reverted")
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one reorg event, got=%d", len(events))
+	}
+	e := events[0]
+	if e.ForkHeight != 1 || e.Depth != 2 || e.OldTip != a3.HashString() || e.NewTip != c4.HashString() {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if len(e.RevertedTxIDs) != 3 || e.RevertedTxIDs[1] != tx.ID() {
+		t.Errorf("unexpected reverted transactions: %v", e.RevertedTxIDs)
+	}
+}
+
+func TestReorganizeInvalidBranch(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	bob := mustPrivKey().PublicKey().Address(network)
+
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransactionS(bob, 10).Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2 := mineEasyBlock(t, b1, tx)
+	if err := Broadcast(a2); err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := mineEasyBlock(t, b1)
+	// bob spends coins he doesn't have
+	bobKey := mustPrivKey()
+	overdraft, err := NewTransactionS(alice.PublicKey().Address(network), 1000).Sign(bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c3 := mineEasyBlock(t, c2, overdraft)
+	c4 := mineEasyBlock(t, c3)
+
+	if err := reorganize([]Block{c2, c3, c4}); err == nil {
+		t.Fatal("branch with an invalid block must be rejected")
+	}
+	if !GetLastBlock().Equals(a2) || blockchain.Len() != 3 {
+		t.Fatal("old tip should be restored")
+	}
+	if Balance(bob) != 10 {
+		t.Errorf("balances should be restored, bob's balance=%d", Balance(bob))
+	}
+	if _, ok := Get(tx.ID()); ok {
+		t.Error("restored transaction should be removed from the mempool")
+	}
+}
+
+// failingStore fails the number of appends.
+type failingStore struct {
+	BlockStore
+	failures int
+}
+
+func (s *failingStore) Append(b Block) error {
+	if s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("disk is full")
+	}
+	return s.BlockStore.Append(b)
+}
+
+func TestReorganizeStoreFailure(t *testing.T) {
+	resetBlockchain(t)
+	fs, err := OpenFileStore(filepath.Join(t.TempDir(), "blocks.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	s := &failingStore{BlockStore: fs}
+	SetBlockStore(s)
+	if err := loadBlockchain(); err != nil {
+		t.Fatal(err)
+	}
+
+	b1 := mineEasyBlock(t, genesisBlock)
+	a2 := mineEasyBlock(t, b1)
+	for _, b := range []Block{b1, a2} {
+		if err := Broadcast(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c2 := mineEasyBlock(t, b1)
+	c3 := mineEasyBlock(t, c2)
+
+	// the old blocks are already truncated when the append fails
+	s.failures = 1
+	if err := reorganize([]Block{c2, c3}); err == nil {
+		t.Fatal("reorganization must fail if the store fails")
+	}
+	if !GetLastBlock().Equals(a2) || blockchain.Len() != 3 {
+		t.Fatal("old tip should be restored in memory")
+	}
+	if _, ok := FindTransaction(c2.Transactions[0].ID()); ok {
+		t.Error("transactions of the new branch mustn't stay indexed")
+	}
+
+	stored, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 3 || !stored[2].Equals(a2) {
+		t.Fatalf("old branch should be restored in the store, got=%d blocks", len(stored))
+	}
+	if err := reorganize([]Block{c2, c3}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := s.Load(); len(stored) != 4 || !stored[3].Equals(c3) {
+		t.Error("new branch should be stored")
+	}
+}
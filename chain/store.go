@@ -0,0 +1,217 @@
+package chain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// BlockStore keeps the blockchain across restarts.
+// Blocks are only ever appended at the tip or truncated from the tip during a reorg.
+type BlockStore interface {
+	// Append durably writes the block on top of the stored chain.
+	Append(b Block) error
+	// Truncate removes every block starting from the height.
+	Truncate(height int) error
+	// Load returns all the stored blocks, genesis first.
+	Load() ([]Block, error)
+	Close() error
+}
+
+var store BlockStore
+
+// SetBlockStore must be called before Run, otherwise the blockchain lives only in memory.
+func SetBlockStore(s BlockStore) {
+	store = s
+}
+
+// FileStore is an append-only file of length-prefixed, checksummed blocks.
+// Every record is: 4 bytes length (LE) | 4 bytes crc32 of the payload (LE) | Block.Encode.
+// A torn record at the end of the file (e.g. the node crashed in the middle of a write) is cut off on Load.
+type FileStore struct {
+	mu sync.Mutex
+	f  *os.File
+	// offsets[i] is where the block at height i starts
+	offsets []int64
+	size    int64
+}
+
+const recordHeaderSize = 8
+
+// OpenFileStore opens the file and finds where its records are, so it can be appended to right away.
+func OpenFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open block store: %s", err)
+	}
+	s := &FileStore{f: f}
+	if err := s.scan(nil); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open block store: %s", err)
+	}
+	return s, nil
+}
+
+func (s *FileStore) Load() ([]Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var blocks []Block
+	err := s.scan(func(payload []byte) error {
+		b, err := DecodeBlock(payload)
+		if err != nil {
+			return fmt.Errorf("block store: failed to decode block at height=%d: %s", len(blocks), err)
+		}
+		blocks = append(blocks, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// scan reads the records from the start, passes each payload to the callback if it's set and indexes their offsets.
+func (s *FileStore) scan(onRecord func(payload []byte) error) error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	var offsets []int64
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		_, err := io.ReadFull(s.f, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("block store: torn record header at offset=%d, truncating", offset)
+				break
+			}
+			return err
+		}
+		length := binary.LittleEndian.Uint32(header[:4])
+		checksum := binary.LittleEndian.Uint32(header[4:])
+		if offset+recordHeaderSize+int64(length) > info.Size() {
+			log.Printf("block store: torn record at offset=%d, truncating", offset)
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.f, payload); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			log.Printf("block store: checksum mismatch at offset=%d, truncating", offset)
+			break
+		}
+		if onRecord != nil {
+			if err := onRecord(payload); err != nil {
+				return err
+			}
+		}
+		offsets = append(offsets, offset)
+		offset += recordHeaderSize + int64(length)
+	}
+
+	// drop whatever is left after the last complete record
+	if err := s.f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.offsets = offsets
+	s.size = offset
+	return nil
+}
+
+func (s *FileStore) Append(b Block) error {
+	payload := b.Encode()
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.WriteAt(record, s.size); err != nil {
+		return fmt.Errorf("block store: write: %s", err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("block store: sync: %s", err)
+	}
+	s.offsets = append(s.offsets, s.size)
+	s.size += int64(len(record))
+	return nil
+}
+
+func (s *FileStore) Truncate(height int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if height < 0 || height > len(s.offsets) {
+		return fmt.Errorf("block store: height out of bound: %d", height)
+	}
+	if height == len(s.offsets) {
+		return nil
+	}
+	newSize := s.offsets[height]
+	if err := s.f.Truncate(newSize); err != nil {
+		return fmt.Errorf("block store: truncate: %s", err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("block store: sync: %s", err)
+	}
+	s.offsets = s.offsets[:height]
+	s.size = newSize
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	return s.f.Close()
+}
+
+// loadBlockchain restores the blockchain from the store and validates every block as if it was broadcasted.
+func loadBlockchain() error {
+	if store == nil {
+		return nil
+	}
+	blocks, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		// fresh store, the genesis block is always the first record.
+		return store.Append(blockchain.Last())
+	}
+
+	if !blocks[0].Equals(genesisBlock) {
+		return fmt.Errorf("stored genesis block doesn't match the network's genesis: hash=%s", blocks[0].HashString())
+	}
+
+	blockchainLock.Lock()
+	defer blockchainLock.Unlock()
+	blockchain.Clear()
+	wallets.Clear()
+	nonces.Clear()
+	addressIndex.Clear()
+	txIndex.Clear()
+	blockchain.Store(genesisBlock.HashString(), genesisBlock)
+	indexTxs(genesisBlock, 0)
+	for i, b := range blocks[1:] {
+		if err := verifyBlock(b); err != nil {
+			return fmt.Errorf("stored block is invalid: %s, height=%d, hash=%s", err, i+1, b.HashString())
+		}
+		connect(b)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package chain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// resetBlockchain switches to Regtest, so that blocks are mined instantly.
+func resetBlockchain(t *testing.T) {
+	resetState := func(n Net) {
+		SetNetwork(n)
+		wallets.Clear()
+		nonces.Clear()
+		memPool.Clear()
+		addressIndex.Clear()
+		templates.Clear()
+	}
+	resetState(Regtest)
+	t.Cleanup(func() {
+		resetState(Mainnet)
+		store = nil
+	})
+}
+
+// heights of the blocks mined by the tests, they may be off the blockchain
+var minedHeights = map[string]int{}
+
+func heightAfter(prev Block) int {
+	height, ok := minedHeights[prev.HashString()]
+	if !ok {
+		height = blockchain.IndexOf(prev.HashString())
+	}
+	return height + 1
+}
+
+// signedCoinbase pays the amount to the address in the block following prev.
+func signedCoinbase(t *testing.T, prev Block, address string, amount Coin, key *PrivateKey) Transaction {
+	ct, err := NewTransactionS(address, amount).Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct.ExtraNonce = CoinbaseExtraNonce(heightAfter(prev), nil)
+	return ct
+}
+
+func mineEasyBlock(t *testing.T, prev Block, txs ...Transaction) Block {
+	return mineEasyBlockPaying(t, prev, mustPrivKey().PublicKey().Address(network), txs...)
+}
+
+// the coinbase reward goes to the address
+func mineEasyBlockPaying(t *testing.T, prev Block, address string, txs ...Transaction) Block {
+	ct := signedCoinbase(t, prev, address, GetMinerReward(), mustPrivKey())
+	b := NewBlock(prev.Hash(), append([]Transaction{ct}, txs...), GetDiffuctlyTargetBits())
+	b.Timestamp = prev.Timestamp + 1
+	b = mine(b)
+	minedHeights[b.HashString()] = heightAfter(prev)
+	return b
+}
+
+func mine(b Block) Block {
+	for !b.Valid() {
+		b.Nonce++
+	}
+	return b
+}
+
+func TestFileStoreAppendLoadTruncate(t *testing.T) {
+	resetBlockchain(t)
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b1 := mineEasyBlock(t, genesisBlock)
+	b2 := mineEasyBlock(t, b1)
+	for _, b := range []Block{genesisBlock, b1, b2} {
+		if err := s.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(b2); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	blocks, err := reopened.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got=%d", len(blocks))
+	}
+	if !blocks[2].Equals(b2) {
+		t.Error("last block didn't match")
+	}
+}
+
+func TestFileStoreAppendAfterReopen(t *testing.T) {
+	resetBlockchain(t)
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := mineEasyBlock(t, genesisBlock)
+	b2 := mineEasyBlock(t, b1)
+	for _, b := range []Block{genesisBlock, b1} {
+		if err := s.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// appending without Load goes after the stored blocks
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Append(b2); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 || !blocks[0].Equals(genesisBlock) || !blocks[2].Equals(b2) {
+		t.Fatalf("expected the stored chain to be kept, got=%d blocks", len(blocks))
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	resetBlockchain(t)
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := mineEasyBlock(t, genesisBlock)
+	if err := s.Append(genesisBlock); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(b1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash in the middle of writing the second block
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	blocks, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 {
+		t.Fatalf("expected only genesis block to survive, got=%d", len(blocks))
+	}
+	// the store must stay appendable after recovery
+	if err := s.Append(b1); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("expected 2 blocks, got=%d", len(blocks))
+	}
+}
+
+func TestLoadBlockchain(t *testing.T) {
+	resetBlockchain(t)
+	s, err := OpenFileStore(filepath.Join(t.TempDir(), "blocks.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	SetBlockStore(s)
+	if err := loadBlockchain(); err != nil {
+		t.Fatal(err)
+	}
+
+	b1 := mineEasyBlock(t, genesisBlock)
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	miner := b1.Transactions[0].Transfers[0]
+
+	// restart
+	blockchain.Clear()
+	wallets.Clear()
+	nonces.Clear()
+	blockchain.Store(genesisBlock.HashString(), genesisBlock)
+	if err := loadBlockchain(); err != nil {
+		t.Fatal(err)
+	}
+	if blockchain.Len() != 2 {
+		t.Fatalf("expected 2 blocks, got=%d", blockchain.Len())
+	}
+	if !GetLastBlock().Equals(b1) {
+		t.Error("last block didn't match")
+	}
+	if amounts, _ := wallets.Load(miner.To); len(amounts) == 0 {
+		t.Error("wallets weren't restored")
+	}
+}
@@ -2,10 +2,13 @@ package chain
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/glossd/fetch"
-	"log"
 	"math/big"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,13 +21,7 @@ func Join(apiUrls []string) error {
 	}
 
 	for _, url := range apiUrls {
-		go func(url string) {
-			// todo sync with memPool
-			err := syncWith(url)
-			if err != nil {
-				log.Printf("disconteecting synchronization, url=\"%s\", error: %s", url, err)
-			}
-		}(url)
+		go gossipWith(url)
 	}
 	return nil
 }
@@ -32,8 +29,7 @@ func Join(apiUrls []string) error {
 func bootstrap(apiUrls []string) error {
 	// Longest Chain Rule
 	// Multiple valid chains may exist at the same time, but one eventually will outgrow another.
-	var longestChain []Block
-	var longestChainTotalWork = new(big.Int)
+	var longestChainTotalWork = GetTotalWork()
 	var longestChainUrl = ""
 	for _, url := range apiUrls {
 		chainWork, err := fetch.Get[[]byte](url+"/api/work", fetch.Config{Timeout: 5 * time.Second})
@@ -44,23 +40,19 @@ func bootstrap(apiUrls []string) error {
 		if newTotalWork.Cmp(longestChainTotalWork) <= 0 {
 			continue
 		}
-		blocks, err := downloadBlocks(url)
-		if err != nil {
-			return err
-		}
-		if newTotalWork != TotalWork(blocks) {
-			return fmt.Errorf("corrupted chain: total work mismatch, apiUrl=%s", url)
-		}
-
-		clear(longestChain) // help gc
-		longestChain = blocks
 		longestChainTotalWork = newTotalWork
 		longestChainUrl = url
 	}
+	if longestChainUrl == "" {
+		return nil
+	}
 
-	setBlockchain(longestChain)
+	err := syncFrom(longestChainUrl)
+	if err != nil {
+		return err
+	}
 
-	err := downloadMempool(longestChainUrl)
+	err = downloadMempool(longestChainUrl)
 	if err != nil {
 		return err
 	}
@@ -68,109 +60,199 @@ func bootstrap(apiUrls []string) error {
 	return nil
 }
 
-func syncWith(apiUrl string) error {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	for {
-		<-ticker.C
-		height, err := fetch.Get[int](apiUrl+"/api/height", fetch.Config{Timeout: 5 * time.Second})
-		if err != nil {
-			return err
-		}
-		if height <= blockchain.Len()-1 {
-			// no new blocks
-			continue
-		}
-		blocks, err := downloadBlocks(apiUrl)
-		if err != nil {
-			return err
-		}
-		if GetTotalWork().Cmp(TotalWork(blocks)) >= 0 {
-			// the other chain has less work but higher, sus.
-			continue
-		}
+// MaxHeadersPerRequest is how many headers GET /api/headers returns at most.
+const MaxHeadersPerRequest = 2000
 
-		replaceBlockchain(blocks)
+// number of blocks in one GET /api/blocks request and how many of them are in flight.
+const (
+	bodiesBatchSize   = 100
+	bodiesParallelism = 4
+)
+
+// syncFrom switches to the chain of the node if it has more work.
+// New blocks normally come with gossip, this is only needed when a block doesn't connect to our tip.
+// Headers-first: only the headers after the fork point are downloaded and validated,
+// then the missing bodies are fetched in parallel batches.
+func syncFrom(apiUrl string) error {
+	forkHeight, headers, err := downloadHeaders(apiUrl)
+	if err != nil {
+		return err
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	branchWork := new(big.Int).Add(TotalWork(blockchain.LoadRangeSafe(0, forkHeight+1)), TotalWork(headers))
+	if GetTotalWork().Cmp(branchWork) >= 0 {
+		// the other chain has less work but higher, sus.
+		return nil
 	}
+
+	bodies, err := downloadBodies(apiUrl, forkHeight+1, headers)
+	if err != nil {
+		return err
+	}
+	return reorganize(bodies)
 }
 
-func replaceBlockchain(blocks []Block) {
-	blockchainLock.Lock()
-	defer blockchainLock.Unlock()
-
-	// find the last valid block according to the new leader chain
-	var lastLocalBlockIndex, lastForeignBlockIndex int
-local:
-	for l := blockchain.Len() - 1; l < 0; l-- {
-		for f := len(blocks) - 1; f < 0; f-- {
-			if blocks[f].Equals(blockchain.LoadIndex(l)) {
-				lastLocalBlockIndex = l
-				lastForeignBlockIndex = f
-				break local
-			}
+// blockLocator lists hashes of our chain from the tip back to the genesis,
+// dense at the tip and exponentially sparser further back, like in Bitcoin.
+func blockLocator() []string {
+	var locator []string
+	step := 1
+	for i := blockchain.Len() - 1; i > 0; i -= step {
+		locator = append(locator, blockchain.LoadIndex(i).HashString())
+		if len(locator) >= 10 {
+			step *= 2
 		}
 	}
+	return append(locator, genesisBlock.HashString())
+}
 
-	// revert orphan blocks if any
-	if lastLocalBlockIndex < blockchain.Len()-1 {
-		deletedBlocks := blockchain.DeleteIndex(lastLocalBlockIndex+1, blockchain.Len()-1)
-		for _, b := range deletedBlocks {
-			markEgested(b.Transactions)
+// headersAfter serves the headers following the first locator hash found in our chain.
+func headersAfter(locator []string, limit int) [][]byte {
+	start := 1 // right after the genesis, which all nodes share
+	for _, h := range locator {
+		if i := blockchain.IndexOf(h); i >= 0 {
+			start = i + 1
+			break
 		}
 	}
-
-	blocksToAdd := blocks[lastForeignBlockIndex+1:]
-	for _, b := range blocksToAdd {
-		persist(b)
+	var res [][]byte
+	for _, b := range blockchain.LoadRangeSafe(start, start+limit) {
+		res = append(res, b.Header())
 	}
+	return res
 }
 
-func TotalWork(blocks []Block) *big.Int {
-	acc := new(big.Int)
-	for _, block := range blocks {
-		acc.Add(acc, block.Work())
+// downloadHeaders fetches the headers of the node's chain after the common ancestor with our chain.
+// Proof-of-work and chaining of every header is validated.
+func downloadHeaders(apiUrl string) (forkHeight int, headers []Block, err error) {
+	locator := blockLocator()
+	forkHeight = -1
+	for {
+		raw, err := fetch.Get[[][]byte](fmt.Sprintf("%s/api/headers?limit=%d&locator=%s", apiUrl, MaxHeadersPerRequest, strings.Join(locator, ",")))
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, r := range raw {
+			h, err := ParseBlockHeader(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			if forkHeight == -1 {
+				forkHeight = blockchain.IndexOf(hex.EncodeToString(h.PreviousHash))
+				if forkHeight == -1 {
+					return 0, nil, fmt.Errorf("headers don't connect to our chain, hash=%s", h.HashString())
+				}
+			}
+			// local blocks up to the fork point, then the downloaded headers
+			blockAt := func(height int) Block {
+				if height <= forkHeight {
+					return blockchain.LoadIndex(height)
+				}
+				return headers[height-forkHeight-1]
+			}
+			if err := verifyHeader(h, forkHeight+1+len(headers), blockAt); err != nil {
+				return 0, nil, err
+			}
+			if len(headers) > 0 && !bytes.Equal(h.PreviousHash, headers[len(headers)-1].Hash()) {
+				return 0, nil, fmt.Errorf("corrupted blockchain: PreviousHash is wrong, hash=%s", h.HashString())
+			}
+			headers = append(headers, h)
+		}
+		if len(raw) < MaxHeadersPerRequest {
+			return forkHeight, headers, nil
+		}
+		// continue from the last received header
+		locator = []string{headers[len(headers)-1].HashString()}
 	}
-	return acc
 }
 
-func downloadBlocks(apiUrl string) ([]Block, error) {
-	blocks, err := fetch.Get[[]Block](apiUrl + "/api/block?sort=asc&limit=-1")
-	if err != nil {
-		return nil, err
+// verifyHeader checks the header at the height on its own, without its transactions.
+// blockAt returns the preceding blocks of the header's chain.
+func verifyHeader(h Block, height int, blockAt func(height int) Block) error {
+	if expected := nextWorkRequired(height, blockAt); h.DifficultyTargetBits != expected {
+		return fmt.Errorf("unexpected difficulty bits: height=%d, hash=%s, expected=%x, got=%x", height, h.HashString(), expected, h.DifficultyTargetBits)
 	}
-	// verifying the peer isn't corrupted
-	for i, block := range blocks {
-		if !block.Valid() {
-			return nil, fmt.Errorf("invalid block found: index=%d, hash=%s", i, block.HashString())
-		}
+	if !h.Valid() {
+		return fmt.Errorf("invalid block header found: height=%d, hash=%s", height, h.HashString())
+	}
+	if err := verifyTimestamp(h, height, blockAt); err != nil {
+		return fmt.Errorf("invalid block header found: height=%d, hash=%s: %s", height, h.HashString(), err)
+	}
+	return nil
+}
 
-		// verify chaining
-		if i > 0 {
-			if !bytes.Equal(block.PreviousHash, blocks[i-1].Hash()) {
-				return nil, fmt.Errorf("corrupted blockchain: PreviousHash is wrong, index=%d", i)
-			}
-		}
+// VerifyHeader is verifyHeader for light clients, which keep only the headers of the chain.
+func VerifyHeader(h Block, height int, blockAt func(height int) Block) error {
+	return verifyHeader(h, height, blockAt)
+}
 
-		// verify integrity of transactions
-		for _, tx := range block.Transactions {
-			err := tx.Verify()
+// downloadBodies fetches the blocks of the headers, the first header is at the height.
+func downloadBodies(apiUrl string, height int, headers []Block) ([]Block, error) {
+	bodies := make([]Block, len(headers))
+	errs := make([]error, (len(headers)+bodiesBatchSize-1)/bodiesBatchSize)
+	sem := make(chan struct{}, bodiesParallelism)
+	var wg sync.WaitGroup
+	for batch := range errs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(batch int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			from := batch * bodiesBatchSize
+			to := min(from+bodiesBatchSize, len(headers))
+			blocks, err := fetch.Get[[]Block](fmt.Sprintf("%s/api/blocks?sort=asc&skip=%d&limit=%d", apiUrl, height+from, to-from))
 			if err != nil {
-				return nil, fmt.Errorf("invalid transaction found: %s, tx_id=%s, block_index=%d, block_hash=%s",
-					err, tx.ID, i, block.HashString())
+				errs[batch] = err
+				return
 			}
-		}
-		if !bytes.Equal(block.MerkleRoot, calcMerkelRoot(block.Transactions)) {
-			return nil, fmt.Errorf("invlaid block, markle root: index=%d, hash=%s", i, block.HashString())
+			if len(blocks) != to-from {
+				errs[batch] = fmt.Errorf("expected %d blocks, got=%d, skip=%d", to-from, len(blocks), height+from)
+				return
+			}
+			for i, b := range blocks {
+				if err := verifyBody(b, headers[from+i]); err != nil {
+					errs[batch] = err
+					return
+				}
+				bodies[from+i] = b
+			}
+		}(batch)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return bodies, nil
+}
+
+// verifyBody checks the block matches the already validated header.
+func verifyBody(b Block, header Block) error {
+	if !b.Equals(header) {
+		return fmt.Errorf("block doesn't match its header, hash=%s", header.HashString())
+	}
+	// verify integrity of transactions
+	for _, tx := range b.Transactions {
+		err := tx.Verify()
+		if err != nil {
+			return fmt.Errorf("invalid transaction found: %s, tx_id=%s, block_hash=%s", err, tx.ID(), b.HashString())
 		}
 	}
-	return blocks, nil
+	if err := verifyMerkleRoot(b); err != nil {
+		return fmt.Errorf("invalid block: %s, hash=%s", err, b.HashString())
+	}
+	return nil
 }
 
-func setBlockchain(blocks []Block) {
+func TotalWork(blocks []Block) *big.Int {
+	acc := new(big.Int)
 	for _, block := range blocks {
-		// whereas Bitcoin recontructs UTXO set, Viatcoin reconstruct the wallets.
-		persist(block)
+		acc.Add(acc, block.Work())
 	}
+	return acc
 }
 
 func downloadMempool(apiUrl string) error {
@@ -181,7 +263,7 @@ func downloadMempool(apiUrl string) error {
 	for _, tx := range txs {
 		err := Push(tx)
 		if err != nil {
-			return fmt.Errorf("failed to add to mempool: %s, tx_id=%s", err, tx.ID)
+			return fmt.Errorf("failed to add to mempool: %s, tx_id=%s", err, tx.ID())
 		}
 	}
 	return nil
@@ -0,0 +1,105 @@
+package chain
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/glossd/fetch"
+)
+
+func TestBlockHeader(t *testing.T) {
+	resetBlockchain(t)
+	b := mineEasyBlock(t, genesisBlock)
+	h := b.Header()
+	if len(h) != BlockHeaderSize {
+		t.Fatalf("expected %d bytes, got=%d", BlockHeaderSize, len(h))
+	}
+	parsed, err := ParseBlockHeader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equals(b) {
+		t.Error("parsed header didn't match the block")
+	}
+	if len(genesisBlock.Header()) != BlockHeaderSize {
+		t.Error("genesis header should be padded to 80 bytes")
+	}
+}
+
+func TestHeadersAfterLocator(t *testing.T) {
+	resetBlockchain(t)
+	prev := genesisBlock
+	for i := 0; i < 30; i++ {
+		b := mineEasyBlock(t, prev)
+		if err := Broadcast(b); err != nil {
+			t.Fatal(err)
+		}
+		prev = b
+	}
+
+	locator := blockLocator()
+	if locator[0] != GetLastBlock().HashString() || locator[len(locator)-1] != genesisBlock.HashString() {
+		t.Fatalf("locator must go from the tip to the genesis: %v", locator)
+	}
+	if len(locator) >= blockchain.Len() {
+		t.Errorf("locator should skip blocks further from the tip, len=%d", len(locator))
+	}
+
+	// a peer which has the first 20 blocks
+	peerLocator := []string{blockchain.LoadIndex(19).HashString(), genesisBlock.HashString()}
+	headers := headersAfter(peerLocator, MaxHeadersPerRequest)
+	if len(headers) != 11 {
+		t.Fatalf("expected 11 headers, got=%d", len(headers))
+	}
+	first, err := ParseBlockHeader(headers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Equals(blockchain.LoadIndex(20)) {
+		t.Error("headers must start right after the common block")
+	}
+
+	if len(headersAfter([]string{"unknown"}, 5)) != 5 {
+		t.Error("unknown locator should start from the genesis")
+	}
+}
+
+func TestVerifyBody(t *testing.T) {
+	resetBlockchain(t)
+	b := mineEasyBlock(t, genesisBlock)
+	header, err := ParseBlockHeader(b.Header())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyBody(b, header); err != nil {
+		t.Fatal(err)
+	}
+	other := mineEasyBlock(t, genesisBlock)
+	if err := verifyBody(other, header); err == nil {
+		t.Error("body of another block shouldn't match the header")
+	}
+	tampered := b
+	tampered.Transactions = append([]Transaction{}, other.Transactions...)
+	if err := verifyBody(tampered, header); err == nil {
+		t.Error("transactions not matching the merkle root should be rejected")
+	}
+}
+
+func TestBlocksOutOfRange(t *testing.T) {
+	resetBlockchain(t)
+	s := httptest.NewServer(APIHandler())
+	defer s.Close()
+
+	for _, query := range []string{"sort=asc&skip=5", "sort=asc&limit=-2", "skip=5", "limit=-2", "skip=-3&limit=-1"} {
+		blocks, err := fetch.Get[[]Block](s.URL + "/api/blocks?" + query)
+		if err != nil {
+			t.Fatalf("query=%s: %s", query, err)
+		}
+		if len(blocks) > 1 {
+			t.Errorf("query=%s: expected at most the genesis, got=%d blocks", query, len(blocks))
+		}
+	}
+	if blocks, err := fetch.Get[[]Block](s.URL + "/api/blocks?sort=asc&limit=-1"); err != nil || len(blocks) != 1 {
+		t.Errorf("expected the whole chain, got=%d blocks: %v", len(blocks), err)
+	}
+}
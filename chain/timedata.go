@@ -0,0 +1,103 @@
+package chain
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Network-adjusted time is the local clock corrected by the median offset of the peers' clocks, like in Bitcoin.
+// A node with a wrong clock would otherwise reject valid blocks or accept blocks from the future.
+
+const (
+	// a block can't be further in the future than that
+	maxFutureBlockTime = 2 * time.Hour
+	// number of previous blocks for the median-time-past
+	medianTimeSpan = 11
+	// the offset is used only when enough peers reported their time
+	minTimeSamples = 5
+	// if the peers disagree with the local clock by more than that, the local clock is trusted.
+	maxTimeOffset = 70 * time.Minute
+	// the samples of the hosts connected later are ignored
+	maxTimeSamples = 200
+)
+
+// keyed by host, so that many connections of one host don't make the median
+var timeOffsets = make(map[string]time.Duration)
+var timeOffsetsLock sync.Mutex
+
+// addTimeSample records the clock of the peer sent at the handshake, the last connection of a host replaces its sample.
+func addTimeSample(peerAddr string, peerTime time.Time) {
+	timeOffsetsLock.Lock()
+	defer timeOffsetsLock.Unlock()
+	host := sampleHost(peerAddr)
+	if _, ok := timeOffsets[host]; !ok && len(timeOffsets) >= maxTimeSamples {
+		return
+	}
+	timeOffsets[host] = time.Until(peerTime)
+}
+
+func removeTimeSample(peerAddr string) {
+	timeOffsetsLock.Lock()
+	defer timeOffsetsLock.Unlock()
+	delete(timeOffsets, sampleHost(peerAddr))
+}
+
+// sampleHost drops the port of the address, like Bitcoin does for the time samples.
+func sampleHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func timeOffset() time.Duration {
+	timeOffsetsLock.Lock()
+	defer timeOffsetsLock.Unlock()
+	if len(timeOffsets) < minTimeSamples {
+		return 0
+	}
+	var offsets []time.Duration
+	for _, o := range timeOffsets {
+		offsets = append(offsets, o)
+	}
+	slices.Sort(offsets)
+	median := offsets[len(offsets)/2]
+	if median > maxTimeOffset || median < -maxTimeOffset {
+		return 0
+	}
+	return median
+}
+
+// NetworkAdjustedTime is the local time corrected by the median offset of the peers' clocks.
+func NetworkAdjustedTime() time.Time {
+	return time.Now().Add(timeOffset())
+}
+
+// medianTimePast returns the median timestamp of the blocks preceding the height, blockAt returns them.
+// A new block's timestamp must be greater than it.
+func medianTimePast(height int, blockAt func(height int) Block) uint32 {
+	var timestamps []uint32
+	for i := height - 1; i >= 0 && i >= height-medianTimeSpan; i-- {
+		timestamps = append(timestamps, blockAt(i).Timestamp)
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	slices.Sort(timestamps)
+	return timestamps[len(timestamps)/2]
+}
+
+// verifyTimestamp checks the timestamp of the block at the height.
+func verifyTimestamp(b Block, height int, blockAt func(height int) Block) error {
+	if mtp := medianTimePast(height, blockAt); b.Timestamp <= mtp {
+		return fmt.Errorf("block timestamp %d must be greater than the median time of the previous blocks %d", b.Timestamp, mtp)
+	}
+	if limit := NetworkAdjustedTime().Add(maxFutureBlockTime); time.Unix(int64(b.Timestamp), 0).After(limit) {
+		return fmt.Errorf("block timestamp %d is too far in the future", b.Timestamp)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBlockTimestamp(t *testing.T) {
+	resetBlockchain(t)
+	prev := genesisBlock
+	for i := 0; i < medianTimeSpan; i++ {
+		b := mineEasyBlock(t, prev)
+		if err := Broadcast(b); err != nil {
+			t.Fatal(err)
+		}
+		prev = b
+	}
+
+	// the median of the previous 11 blocks is the 6th from the tip
+	mtp := blockchain.LoadIndex(blockchain.Len() - 6).Timestamp
+	if medianTimePast(blockchain.Len(), blockchain.LoadIndex) != mtp {
+		t.Fatalf("expected median time %d, got=%d", mtp, medianTimePast(blockchain.Len(), blockchain.LoadIndex))
+	}
+
+	old := mineEasyBlock(t, prev)
+	old.Timestamp = mtp
+	if err := Broadcast(mine(old)); err == nil {
+		t.Error("block with timestamp not greater than median time past must be rejected")
+	}
+
+	future := mineEasyBlock(t, prev)
+	future.Timestamp = uint32(time.Now().Add(maxFutureBlockTime + time.Minute).Unix())
+	if err := Broadcast(mine(future)); err == nil {
+		t.Error("block too far in the future must be rejected")
+	}
+
+	// a bit older than the tip is fine
+	b := mineEasyBlock(t, prev)
+	b.Timestamp = mtp + 1
+	if err := Broadcast(mine(b)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNetworkAdjustedTime(t *testing.T) {
+	t.Cleanup(func() { clear(timeOffsets) })
+	ahead := time.Now().Add(time.Hour)
+	for i := 0; i < minTimeSamples-1; i++ {
+		addTimeSample(fmt.Sprintf("peer%d", i), ahead)
+	}
+	if timeOffset() != 0 {
+		t.Error("offset shouldn't be used with too few samples")
+	}
+	addTimeSample("peer", ahead)
+	if offset := timeOffset(); offset < 59*time.Minute || offset > time.Hour {
+		t.Errorf("expected an hour offset, got=%s", offset)
+	}
+
+	for i := 0; i < minTimeSamples; i++ {
+		addTimeSample(fmt.Sprintf("peer%d", i), time.Now().Add(3*time.Hour))
+	}
+	if timeOffset() != 0 {
+		t.Error("offset larger than the max should be ignored")
+	}
+	for i := 0; i < minTimeSamples; i++ {
+		removeTimeSample(fmt.Sprintf("peer%d", i))
+	}
+	if timeOffset() != 0 {
+		t.Error("disconnected peers shouldn't count")
+	}
+}
+
+func TestTimeSamplesByHost(t *testing.T) {
+	t.Cleanup(func() { clear(timeOffsets) })
+	// one host opens many connections from different ports
+	ahead := time.Now().Add(time.Hour)
+	for i := 0; i < minTimeSamples; i++ {
+		addTimeSample(fmt.Sprintf("10.0.0.1:%d", 40000+i), ahead)
+	}
+	if len(timeOffsets) != 1 || timeOffset() != 0 {
+		t.Errorf("connections of one host must be one sample, got=%d", len(timeOffsets))
+	}
+
+	for i := 0; i < maxTimeSamples+10; i++ {
+		addTimeSample(fmt.Sprintf("10.1.%d.%d:8333", i/256, i%256), ahead)
+	}
+	if len(timeOffsets) != maxTimeSamples {
+		t.Errorf("expected %d samples at most, got=%d", maxTimeSamples, len(timeOffsets))
+	}
+}
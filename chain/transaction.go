@@ -1,14 +1,12 @@
 package chain
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/big"
-
-	"github.com/google/uuid"
 )
 
 type Coin uint64
@@ -18,6 +16,26 @@ const (
 	Viatcoin      = 1e8 * Gloshi
 )
 
+// MaxMoney is the most coins there can ever be, no amount and no sum of amounts may exceed it.
+// The block reward halves every 210,000 blocks, so the supply converges to 21 million viatcoins.
+const MaxMoney = 21_000_000 * Viatcoin
+
+// Add fails if the sum exceeds MaxMoney, which also rules out the uint64 overflow.
+func (c Coin) Add(o Coin) (Coin, error) {
+	if c > MaxMoney || o > MaxMoney-c {
+		return 0, fmt.Errorf("amount exceeds the max money supply: %d + %d", c, o)
+	}
+	return c + o, nil
+}
+
+// Sub fails if the result is negative.
+func (c Coin) Sub(o Coin) (Coin, error) {
+	if o > c {
+		return 0, fmt.Errorf("negative amount: %d - %d", c, o)
+	}
+	return c - o, nil
+}
+
 func (c Coin) AsViatcoins() float64 {
 	res, _ := new(big.Float).Quo(new(big.Float).SetUint64(uint64(c)), new(big.Float).SetInt64(1e8)).Float64()
 	return res
@@ -26,18 +44,39 @@ func (c Coin) AsViatcoins() float64 {
 // I did not like UTXOs, they really made the transactions complicated.
 // Each transaction is address-based.
 
+// A transaction is identified by its txid, see ID.
 type Transaction struct {
 	Version uint32
-	ID      string
 	// filled with Sign
 	From string
+	// Nonce is the number of transactions the sender has already got into the blockchain.
+	// It's signed with the rest of the transaction, so a mined transaction can't be replayed.
+	// The next nonce of an address is served by /api/address/{addr}/nonce.
+	Nonce uint64
 
 	Transfers []Transfer
+	// Fee goes to the miner on top of the block reward.
+	// Miners pick transactions with the highest fee per byte first.
+	Fee Coin
 
 	// ScriptSig is divided
 	Signature []byte
 	PublicKey []byte
-	// todo add miner fee, for now only block reward
+
+	// ExtraNonce is only allowed in the coinbase, it's what the miner changes once the nonce of the header is exhausted.
+	// Like the signature, it isn't signed, so it changes the txid and the merkle root without signing again.
+	// It starts with the height of the block, see CoinbaseExtraNonce.
+	ExtraNonce []byte
+}
+
+// MaxExtraNonceSize is the longest extra nonce of the coinbase.
+const MaxExtraNonceSize = 32
+
+// CoinbaseExtraNonce is the extra nonce of the coinbase of the block at the height, the miner's extra bytes follow the height.
+// Like in Bitcoin's BIP34, the height makes every coinbase unique, otherwise a coinbase could be copied to another block
+// and two transactions would have the same txid.
+func CoinbaseExtraNonce(height int, extra []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(height)), extra...)
 }
 
 type Transfer struct {
@@ -48,7 +87,6 @@ type Transfer struct {
 func NewTransactionS(to string, amount Coin) Transaction {
 	return Transaction{
 		Version:   1,
-		ID:        uuid.New().String(),
 		Transfers: []Transfer{{To: to, Amount: amount}},
 	}
 }
@@ -56,34 +94,58 @@ func NewTransactionS(to string, amount Coin) Transaction {
 func NewTransaction(to []Transfer) Transaction {
 	return Transaction{
 		Version:   1,
-		ID:        uuid.New().String(),
 		Transfers: to,
 	}
 }
 
+// Serialize returns the canonical encoding of the transaction without the signature and the extra nonce, it's what gets signed.
 func (t Transaction) Serialize() ([]byte, error) {
 	if t.From == "" {
 		return nil, fmt.Errorf("can't serialize before signing")
 	}
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
+	var e encoder
+	t.encodeUnsigned(&e)
+	return e.buf.Bytes(), nil
+}
 
-	copyT := t
-	copyT.Signature = nil
-	copyT.PublicKey = nil
-	err := enc.Encode(copyT)
-	if err != nil {
-		return nil, fmt.Errorf("serialization: %s", err)
-	}
-	return buf.Bytes(), nil
+// Size is the number of bytes the signed transaction takes.
+func (t Transaction) Size() int {
+	return len(t.Encode())
+}
+
+func (t Transaction) FeePerByte() float64 {
+	return float64(t.Fee) / float64(t.Size())
 }
 
+// DoubleSha256 is the txid in bytes, it's the leaf of the merkle tree.
+// It covers the signature, so it's only final after Sign.
 func (t Transaction) DoubleSha256() []byte {
+	return doubleSHA256(t.Encode())
+}
+
+// ID is the txid, the hex of the double SHA-256 of the signed transaction.
+// It's computed rather than stored, so two nodes can't disagree on it.
+func (t Transaction) ID() string {
+	return hex.EncodeToString(t.DoubleSha256())
+}
+
+// MarshalJSON adds the txid for the API clients, it's ignored when unmarshalling.
+func (t Transaction) MarshalJSON() ([]byte, error) {
+	type plain Transaction
+	return json.Marshal(struct {
+		ID string
+		plain
+	}{ID: t.ID(), plain: plain(t)})
+}
+
+// sigHash is what the private key signs.
+// ECDSA signs only as many bytes as the curve order has, so the whole serialization must be hashed first.
+func (t Transaction) sigHash() ([]byte, error) {
 	ser, err := t.Serialize()
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return doubleSHA256([]byte(hex.EncodeToString(ser)))
+	return doubleSHA256(ser), nil
 }
 
 func (t Transaction) Sign(key *PrivateKey) (Transaction, error) {
@@ -92,12 +154,11 @@ func (t Transaction) Sign(key *PrivateKey) (Transaction, error) {
 	}
 	// from is populated before serialization, so that we know it wasn't tempered after verification.
 	t.From = key.PublicKey().Address(network)
-	ser, err := t.Serialize()
+	hash, err := t.sigHash()
 	if err != nil {
 		return t, err
 	}
-	// did I need to doubleSha256 the transaction data?
-	signature, err := key.Sign(ser)
+	signature, err := key.Sign(hash)
 	// I believe the signature is already DER encoded
 	if err != nil {
 		return t, fmt.Errorf("failed to sign: %s", err)
@@ -120,11 +181,11 @@ func (t Transaction) Verify() error {
 	if pubKeyAddr != t.From {
 		return fmt.Errorf("address of the public key '%s' didn't match transaction's address: %s", pubKeyAddr, t.From)
 	}
-	ser, err := t.Serialize()
+	hash, err := t.sigHash()
 	if err != nil {
 		return err
 	}
-	ok := pubKey.Verify(ser, t.Signature)
+	ok := pubKey.Verify(hash, t.Signature)
 	if !ok {
 		return fmt.Errorf("failed to verify")
 	}
@@ -1,6 +1,7 @@
 package chain
 
 import (
+	"math"
 	"testing"
 )
 
@@ -26,3 +27,81 @@ func TestCoinAsViatcoin(t *testing.T) {
 		t.Error("expected 1")
 	}
 }
+
+func TestTransactionID(t *testing.T) {
+	tx, err := NewTransactionS(mustPrivKey().PublicKey().Address(network), 1).Sign(mustPrivKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.ID()) != 64 {
+		t.Fatalf("txid must be a hex of 32 bytes, got=%s", tx.ID())
+	}
+	decoded, err := DecodeTransaction(tx.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID() != tx.ID() {
+		t.Error("txid must survive the encoding")
+	}
+	tampered := tx
+	tampered.Fee++
+	if tampered.ID() == tx.ID() {
+		t.Error("txid must change with the content")
+	}
+	if tampered.Verify() == nil {
+		t.Error("the fee must be covered by the signature")
+	}
+
+	extra := tx
+	extra.ExtraNonce = []byte{1, 0, 0, 0}
+	if extra.ID() == tx.ID() {
+		t.Error("txid must change with the extra nonce")
+	}
+	if err := extra.Verify(); err != nil {
+		t.Error("the extra nonce mustn't be signed: ", err)
+	}
+	if decoded, err := DecodeTransaction(extra.Encode()); err != nil || decoded.ID() != extra.ID() {
+		t.Errorf("extra nonce must survive the encoding: %v", err)
+	}
+}
+
+func TestCoinArithmetic(t *testing.T) {
+	if sum, err := Coin(1).Add(2); err != nil || sum != 3 {
+		t.Errorf("1+2=%d, %v", sum, err)
+	}
+	if sum, err := MaxMoney.Add(0); err != nil || sum != MaxMoney {
+		t.Errorf("max money itself must be allowed: %v", err)
+	}
+	if _, err := MaxMoney.Add(1); err == nil {
+		t.Error("sum above max money must fail")
+	}
+	if _, err := Coin(math.MaxUint64).Add(2); err == nil {
+		t.Error("overflow must fail")
+	}
+	if diff, err := Coin(3).Sub(2); err != nil || diff != 1 {
+		t.Errorf("3-2=%d, %v", diff, err)
+	}
+	if _, err := Coin(2).Sub(3); err == nil {
+		t.Error("negative result must fail")
+	}
+}
+
+func TestTransactionAmounts(t *testing.T) {
+	to := mustPrivKey().PublicKey().Address(network)
+	for name, tx := range map[string]Transaction{
+		"no transfers":        NewTransaction(nil),
+		"zero transfer":       NewTransaction([]Transfer{{To: to, Amount: 1}, {To: to, Amount: 0}}),
+		"overflow":            NewTransaction([]Transfer{{To: to, Amount: math.MaxUint64}, {To: to, Amount: 2}}),
+		"exceeds max money":   NewTransaction([]Transfer{{To: to, Amount: MaxMoney}, {To: to, Amount: 1}}),
+		"fee above max money": {Version: 1, Transfers: []Transfer{{To: to, Amount: 1}}, Fee: math.MaxUint64},
+	} {
+		if _, err := tx.fullAmount(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	tx := NewTransaction([]Transfer{{To: to, Amount: 5}, {To: to, Amount: 6}})
+	tx.Fee = 1
+	if amount, err := tx.fullAmount(); err != nil || amount != 12 {
+		t.Errorf("unexpected full amount=%d, %v", amount, err)
+	}
+}
@@ -0,0 +1,86 @@
+package chain
+
+import (
+	"github.com/glossd/viatcoin/chain/util"
+)
+
+// txLocation is where a confirmed transaction is in the blockchain.
+type txLocation struct {
+	BlockHash string
+	Height    int
+	// position in Block.Transactions
+	Index int
+}
+
+// txid -> location, only the transactions of the blockchain, not of the mempool.
+var txIndex = util.Map[string, txLocation]{}
+
+// indexTxs keeps the earlier location of a txid, if it's still in the blockchain, like Bitcoin's BIP30.
+// The coinbase height makes the txids unique, it's only a safety net.
+func indexTxs(b Block, height int) {
+	hash := b.HashString()
+	for i, t := range b.Transactions {
+		if loc, ok := txIndex.Load(t.ID()); ok && loc.Height < height && blockchain.IndexOf(loc.BlockHash) == loc.Height {
+			continue
+		}
+		txIndex.Store(t.ID(), txLocation{BlockHash: hash, Height: height, Index: i})
+	}
+}
+
+// unindexTxs removes only the locations pointing at the block.
+func unindexTxs(b Block) {
+	hash := b.HashString()
+	for _, t := range b.Transactions {
+		if loc, ok := txIndex.Load(t.ID()); ok && loc.BlockHash == hash {
+			txIndex.Delete(t.ID())
+		}
+	}
+}
+
+const (
+	TxPending   = "pending"
+	TxConfirmed = "confirmed"
+)
+
+type TxStatus struct {
+	Transaction Transaction
+	// either pending or confirmed
+	Status string
+	// the fields below are filled only for the confirmed transactions
+	BlockHash     string `json:",omitempty"`
+	Height        int
+	Index         int
+	Confirmations int
+}
+
+// findConfirmed returns the block of the transaction and its location.
+func findConfirmed(txID string) (Block, txLocation, bool) {
+	loc, ok := txIndex.Load(txID)
+	if !ok {
+		return Block{}, txLocation{}, false
+	}
+	// the block could've been disconnected in the meantime
+	b, ok := blockchain.Load(loc.BlockHash)
+	if !ok || loc.Index >= len(b.Transactions) {
+		return Block{}, txLocation{}, false
+	}
+	return b, loc, true
+}
+
+// FindTransaction looks for the transaction in the blockchain and then in the mempool.
+func FindTransaction(txID string) (TxStatus, bool) {
+	if b, loc, ok := findConfirmed(txID); ok {
+		return TxStatus{
+			Transaction:   b.Transactions[loc.Index],
+			Status:        TxConfirmed,
+			BlockHash:     loc.BlockHash,
+			Height:        loc.Height,
+			Index:         loc.Index,
+			Confirmations: blockchain.Len() - loc.Height,
+		}, true
+	}
+	if t, ok := Get(txID); ok {
+		return TxStatus{Transaction: t, Status: TxPending}, true
+	}
+	return TxStatus{}, false
+}
@@ -0,0 +1,92 @@
+package chain
+
+import (
+	"testing"
+)
+
+func TestFindTransaction(t *testing.T) {
+	resetBlockchain(t)
+	alice := mustPrivKey()
+	bob := mustPrivKey().PublicKey().Address(network)
+
+	b1 := mineEasyBlockPaying(t, genesisBlock, alice.PublicKey().Address(network))
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransactionS(bob, 10).Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(tx); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := FindTransaction(tx.ID()); !ok || s.Status != TxPending || s.Confirmations != 0 {
+		t.Fatalf("expected pending transaction: %+v", s)
+	}
+
+	a2 := mineEasyBlock(t, b1, tx)
+	if err := Broadcast(a2); err != nil {
+		t.Fatal(err)
+	}
+	a3 := mineEasyBlock(t, a2)
+	if err := Broadcast(a3); err != nil {
+		t.Fatal(err)
+	}
+	s, ok := FindTransaction(tx.ID())
+	if !ok || s.Status != TxConfirmed || s.BlockHash != a2.HashString() || s.Height != 2 || s.Index != 1 || s.Confirmations != 2 {
+		t.Fatalf("unexpected confirmed transaction: %+v", s)
+	}
+	if s.Transaction.ID() != tx.ID() {
+		t.Error("found another transaction")
+	}
+	if s, ok := FindTransaction(genesisBlock.Transactions[0].ID()); !ok || s.Height != 0 {
+		t.Errorf("genesis coinbase must be found: %+v", s)
+	}
+
+	// orphaned, the transaction is pending again
+	c2 := mineEasyBlock(t, b1)
+	c3 := mineEasyBlock(t, c2)
+	c4 := mineEasyBlock(t, c3)
+	if err := reorganize([]Block{c2, c3, c4}); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := FindTransaction(tx.ID()); !ok || s.Status != TxPending {
+		t.Errorf("expected pending transaction after reorg: %+v", s)
+	}
+	if _, ok := FindTransaction(a3.Transactions[0].ID()); ok {
+		t.Error("orphaned coinbase must not be found")
+	}
+}
+
+func TestDisconnectKeepsEarlierLocation(t *testing.T) {
+	resetBlockchain(t)
+	b1 := mineEasyBlock(t, genesisBlock)
+	if err := Broadcast(b1); err != nil {
+		t.Fatal(err)
+	}
+	coinbase := b1.Transactions[0]
+	// a block repeating the coinbase of block 1, it can't be connected since the coinbase has the height,
+	// but the index mustn't lose the transaction either way.
+	b2 := mineEasyBlock(t, b1)
+	b2.Transactions = append(b2.Transactions, coinbase)
+	indexTxs(b2, 2)
+	if s, ok := FindTransaction(coinbase.ID()); !ok || s.BlockHash != b1.HashString() {
+		t.Fatalf("the earlier location must be kept: %+v", s)
+	}
+	unindexTxs(b2)
+	if s, ok := FindTransaction(coinbase.ID()); !ok || s.BlockHash != b1.HashString() || s.Height != 1 {
+		t.Fatalf("disconnecting another block must keep the location: %+v", s)
+	}
+
+	a2 := mineEasyBlock(t, b1)
+	if err := Broadcast(a2); err != nil {
+		t.Fatal(err)
+	}
+	disconnectAfter(1)
+	if _, ok := FindTransaction(a2.Transactions[0].ID()); ok {
+		t.Error("coinbase of the disconnected block must be unindexed")
+	}
+	if s, ok := FindTransaction(coinbase.ID()); !ok || s.Height != 1 {
+		t.Errorf("coinbase of block 1 must stay: %+v", s)
+	}
+}
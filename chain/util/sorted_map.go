@@ -31,7 +31,7 @@ func (sm *SortedMap[K, V]) Delete(key K) {
 	if i == -1 {
 		return
 	}
-	_ = slices.Delete(sm.order, i, i+1)
+	sm.order = slices.Delete(sm.order, i, i+1)
 }
 
 // DeleteIndex removes the elements s[i:j] from s
@@ -41,8 +41,8 @@ func (sm *SortedMap[K, V]) DeleteIndex(i, j int) (deleted []V) {
 	defer sm.mu.Unlock()
 	sm.init()
 
-	keys := sm.order[i:j]
-	slices.Delete(sm.order, i, j)
+	keys := slices.Clone(sm.order[i:j])
+	sm.order = slices.Delete(sm.order, i, j)
 	for _, key := range keys {
 		deleted = append(deleted, sm.inner[key])
 		delete(sm.inner, key)
@@ -67,6 +67,24 @@ func (sm *SortedMap[K, V]) LoadIndex(i int) V {
 	return sm.inner[sm.order[i]]
 }
 
+// IndexOf returns -1 if the key isn't present.
+// O(n), the most recent keys are checked first.
+func (sm *SortedMap[K, V]) IndexOf(key K) int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	sm.init()
+
+	if _, ok := sm.inner[key]; !ok {
+		return -1
+	}
+	for i := len(sm.order) - 1; i >= 0; i-- {
+		if sm.order[i] == key {
+			return i
+		}
+	}
+	return -1
+}
+
 func (sm *SortedMap[K, V]) Last() V {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
@@ -95,12 +113,8 @@ func (sm *SortedMap[K, V]) LoadRangeSafe(i, j int) []V {
 	sm.init()
 
 	var res []V
-	if i < 0 {
-		i = 0
-	}
-	if j > len(sm.order) {
-		j = len(sm.order)
-	}
+	i = min(max(i, 0), len(sm.order))
+	j = min(max(j, i), len(sm.order))
 	for _, key := range sm.order[i:j] {
 		res = append(res, sm.inner[key])
 	}
@@ -144,5 +158,5 @@ func (sm *SortedMap[K, V]) Clear() {
 	defer sm.mu.Unlock()
 
 	clear(sm.inner)
-	clear(sm.order)
+	sm.order = sm.order[:0]
 }
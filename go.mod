@@ -6,7 +6,6 @@ require (
 	github.com/decred/base58 v1.0.5
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.4.0
 	github.com/glossd/fetch v1.0.2
-	github.com/google/uuid v1.6.0
 	golang.org/x/crypto v0.35.0
 )
 
@@ -6,6 +6,13 @@ import (
 )
 
 func main() {
+	store, err := chain.OpenFileStore("blocks.dat")
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	chain.SetBlockStore(store)
+	chain.EnableAddressIndex()
 	go chain.Run(8333)
 
 	pk, err := chain.NewPrivateKey()
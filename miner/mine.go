@@ -1,9 +1,12 @@
 package miner
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"math"
-	"strings"
+	"net/http"
+	"runtime"
 	"time"
 
 	"github.com/glossd/fetch"
@@ -11,9 +14,13 @@ import (
 )
 
 type StartConfig struct {
-	Pk           *chain.PrivateKey // required
-	Network      chain.Net         // defaults to Mainnet
-	ApiUrl       string
+	Pk      *chain.PrivateKey // required
+	Network chain.Net         // defaults to Mainnet
+	ApiUrl  string
+	// number of goroutines searching for the nonce, defaults to the number of CPUs
+	Workers int
+	// how often the node is asked for a new tip or new transactions, defaults to 2 seconds
+	PollInterval time.Duration
 }
 
 func Start(cfg StartConfig) {
@@ -23,82 +30,128 @@ func Start(cfg StartConfig) {
 	if cfg.Pk == nil {
 		panic("private key isn't specified")
 	}
-	lb, err := fetch.Get[chain.Block]("/blocks/last")
-	if err != nil {
-		panic(err)	
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.NumCPU()
 	}
-	txs, err := fetch.Get[[]chain.Transaction]("/mempool?limit=999")
-	if err != nil {
-		panic(err)	
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 2 * time.Second
 	}
+	meter.start(10 * time.Second)
+	backoff := minBackoff
+	for {
+		if err := mineBlock(cfg); err != nil {
+			fmt.Printf("failed to get work from the node, retrying in %s: %s\n", backoff, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+	}
+}
 
-	difTargetBits, err := fetch.Get[uint32]("/difficulty/target/bits")
+// the node may be restarting, it's asked for work less and less often
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// work is the template the block is built from.
+type work struct {
+	chain.BlockTemplate
+}
+
+func fetchWork() (work, error) {
+	t, err := fetch.Get[chain.BlockTemplate]("/mining/template")
 	if err != nil {
-		panic(err)	
+		return work{}, err
 	}
+	return work{t}, nil
+}
+
+// stale is true if the work no longer builds on the tip or misses transactions of the mempool.
+func (w work) stale(fresh work) bool {
+	return fresh.ID != w.ID
+}
 
-	minerReward, err := fetch.Get[chain.Coin]("/reward")
+// mineBlock fails only if the node can't be reached.
+func mineBlock(cfg StartConfig) error {
+	w, err := fetchWork()
 	if err != nil {
-		panic(err)	
+		return err
 	}
 
 	pkAddress := cfg.Pk.PublicKey().Address(cfg.Network)
-	coinbaseTx, err := chain.NewTransactionS(pkAddress, minerReward).Sign(cfg.Pk)
+	earned := w.Reward + w.Fees
+	coinbaseTx, err := chain.NewTransactionS(pkAddress, earned).Sign(cfg.Pk)
 	if err != nil {
 		panic("failed to sign coinbase transaction" + err.Error())
 	}
-	if len(txs) == 0 {
-		txs = []chain.Transaction{coinbaseTx}
-	} else {
-		swap := txs[0]
-		txs[0] = coinbaseTx
-		txs = append(txs, swap)
-	}
 
-	block := searchForValidBlock(lb, txs, difTargetBits)
-	_, err = fetch.Post[fetch.Empty]("/blocks", block)
-	if err != nil {
-		if strings.Contains(err.Error(), "invalid previous hash") {
-			Start(cfg)
-			return
-		} else {
-			panic("broadcasting valid block failed: " + err.Error())
-		}
-	} else {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchStale(ctx, cancel, w, cfg.PollInterval)
+
+	block, ok := searchForValidBlock(ctx, w.BlockTemplate, coinbaseTx, cfg.Workers)
+	if !ok {
+		fmt.Println("new tip or transactions, restarting the work")
+		return nil
+	}
+	stale, err := submit(w, block)
+	switch {
+	case stale:
+		fmt.Println("another block was found first, restarting the work")
+	case err != nil:
+		fmt.Printf("block rejected: %s\n", err)
+	default:
 		fmt.Printf("broadcasted block, earned %.2f Viatcoins\n Hash: %s\n Diff: %064s\n\n",
-			minerReward.AsViatcoins(), block.HashString(), block.DifficultyTarget().Text(16))
+			earned.AsViatcoins(), block.HashString(), block.DifficultyTarget().Text(16))
 	}
-	Start(cfg)
+	return nil
 }
 
-func searchForValidBlock(last chain.Block, txs []chain.Transaction, difTarBits uint32) chain.Block {
-	b := chain.NewBlock(last.Hash(), txs, difTarBits)
-	n, ok := bruteForceNonce(b)
-	if ok {
-		b.Nonce = n
-		return b
-	} else {
-		fmt.Println("nonce exhausted, changing timestamp")
-		return searchForValidBlock(last, txs, difTarBits)
+// submit sends the solved block, it's stale if the node responds with 409 Conflict.
+func submit(w work, b chain.Block) (stale bool, err error) {
+	_, err = fetch.Post[string]("/mining/submit", chain.BlockSubmission{TemplateID: w.ID, Block: b})
+	var fetchErr *fetch.Error
+	if errors.As(err, &fetchErr) && fetchErr.Status == http.StatusConflict {
+		return true, err
 	}
+	return false, err
 }
 
-func bruteForceNonce(b chain.Block) (uint32, bool) {
-	var nonce uint32
-	printTime := time.Now()
+// watchStale polls the node and cancels the work when it becomes stale.
+func watchStale(ctx context.Context, cancel context.CancelFunc, w work, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		b.Nonce = nonce
-		if b.Valid() {
-			return b.Nonce, true
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		if math.MaxUint32 == b.Nonce {
-			return 0, false
+		fresh, err := fetchWork()
+		if err != nil {
+			fmt.Printf("failed to poll the node: %s\n", err)
+			continue
+		}
+		if w.stale(fresh) {
+			cancel()
+			return
+		}
+	}
+}
+
+// searchForValidBlock solves the block of the template. Each exhausted nonce space moves on to the next extra nonce,
+// which changes the coinbase and thus the merkle root, so no header is hashed twice.
+func searchForValidBlock(ctx context.Context, t chain.BlockTemplate, coinbase chain.Transaction, workers int) (chain.Block, bool) {
+	for extraNonce := uint64(0); ; extraNonce++ {
+		coinbase.ExtraNonce = chain.CoinbaseExtraNonce(t.Height, binary.LittleEndian.AppendUint64(nil, extraNonce))
+		b, ok := solve(ctx, t.NewBlock(coinbase), workers)
+		if ok {
+			return b, true
 		}
-		nonce++
-		now := time.Now()
-		if now.Compare(printTime.Add(time.Minute)) > 0 {
-			printTime = now
-			fmt.Printf("still brute forcing... nonce=%d\n", nonce)
+		if ctx.Err() != nil {
+			return b, false
 		}
 	}
 }
@@ -0,0 +1,103 @@
+package miner
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/glossd/fetch"
+	"github.com/glossd/viatcoin/chain"
+)
+
+// startNode serves the API of an in-memory Regtest node.
+func startNode(t *testing.T) {
+	chain.SetNetwork(chain.Regtest)
+	s := httptest.NewServer(chain.APIHandler())
+	fetch.SetBaseURL(s.URL + "/api")
+	t.Cleanup(func() {
+		s.Close()
+		fetch.SetBaseURL("")
+		chain.SetNetwork(chain.Mainnet)
+	})
+}
+
+func TestWatchStale(t *testing.T) {
+	startNode(t)
+	w, err := fetchWork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh, err := fetchWork(); err != nil || w.stale(fresh) {
+		t.Fatalf("the same work mustn't be stale: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchStale(ctx, cancel, w, 10*time.Millisecond)
+
+	// another miner finds the block
+	pk, err := chain.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := chain.NewTransactionS(pk.PublicKey().Address(chain.Regtest), w.Reward).Sign(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok := searchForValidBlock(context.Background(), w.BlockTemplate, cb, 1)
+	if !ok {
+		t.Fatal("expected a block")
+	}
+	if err := chain.Broadcast(b); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("work on the old tip wasn't abandoned")
+	}
+}
+
+func TestSubmitStale(t *testing.T) {
+	startNode(t)
+	w, err := fetchWork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineOn := func(w work) chain.Block {
+		pk, err := chain.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb, err := chain.NewTransactionS(pk.PublicKey().Address(chain.Regtest), w.Reward).Sign(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, ok := searchForValidBlock(context.Background(), w.BlockTemplate, cb, 1)
+		if !ok {
+			t.Fatal("expected a block")
+		}
+		return b
+	}
+	first, second := mineOn(w), mineOn(w)
+	if stale, err := submit(w, first); stale || err != nil {
+		t.Fatalf("first block must be accepted: %v", err)
+	}
+	if stale, err := submit(w, second); !stale {
+		t.Errorf("block of the old tip must be stale: %v", err)
+	}
+}
+
+func TestMineBlockNodeDown(t *testing.T) {
+	startNode(t)
+	fetch.SetBaseURL("http://127.0.0.1:1/api")
+	pk, err := chain.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mineBlock(StartConfig{Pk: pk, Network: chain.Regtest}); err == nil {
+		t.Error("expected an error for an unreachable node")
+	}
+}
@@ -0,0 +1,138 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glossd/viatcoin/chain"
+)
+
+// the nonce is the last field of the 80-byte header
+const nonceOffset = chain.BlockHeaderSize - 4
+
+// workers check the cancellation and report hashes once per batch
+const hashBatch = 1 << 16
+
+// solve searches the nonce of the block with the workers, each one walks its own part of the nonce space.
+// The first found nonce stops all the workers. It returns false if the whole space was searched
+// or the context was cancelled.
+func solve(ctx context.Context, b chain.Block, workers int) (chain.Block, bool) {
+	workers = max(workers, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	header := b.Header()
+	target := targetBytes(b.DifficultyTarget())
+	found := make(chan uint32, workers)
+	span := uint64(math.MaxUint32+1) / uint64(workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		from := uint64(w) * span
+		to := from + span
+		if w == workers-1 {
+			to = math.MaxUint32 + 1
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if nonce, ok := searchRange(ctx, header, target, from, to); ok {
+				found <- nonce
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	close(found)
+	nonce, ok := <-found
+	if !ok {
+		return b, false
+	}
+	b.Nonce = nonce
+	return b, true
+}
+
+// searchRange hashes the header with every nonce in [from, to).
+// Only the nonce changes, so the header isn't rebuilt.
+func searchRange(ctx context.Context, header []byte, target [32]byte, from, to uint64) (uint32, bool) {
+	h := bytes.Clone(header)
+	var done uint64
+	defer func() { meter.add(done) }()
+	for n := from; n < to; n++ {
+		if done == hashBatch {
+			meter.add(done)
+			done = 0
+			if ctx.Err() != nil {
+				return 0, false
+			}
+		}
+		binary.LittleEndian.PutUint32(h[nonceOffset:], uint32(n))
+		first := sha256.Sum256(h)
+		hash := sha256.Sum256(first[:])
+		done++
+		if bytes.Compare(hash[:], target[:]) <= 0 {
+			return uint32(n), true
+		}
+	}
+	return 0, false
+}
+
+// targetBytes is the target as a 32-byte big-endian number, comparable with a hash like chain.Block.Valid does.
+func targetBytes(target *big.Int) [32]byte {
+	var res [32]byte
+	if target.BitLen() > 256 {
+		// every hash meets the target
+		for i := range res {
+			res[i] = 0xff
+		}
+		return res
+	}
+	target.FillBytes(res[:])
+	return res
+}
+
+type hashrateMeter struct {
+	hashes atomic.Uint64
+	// hashes per second of the last interval, float64 bits
+	rate atomic.Uint64
+	once sync.Once
+}
+
+var meter hashrateMeter
+
+func (m *hashrateMeter) add(n uint64) {
+	m.hashes.Add(n)
+}
+
+// start samples the hashrate of all the workers every interval and prints it every minute.
+func (m *hashrateMeter) start(interval time.Duration) {
+	m.once.Do(func() {
+		go func() {
+			last := m.hashes.Load()
+			lastTime := time.Now()
+			printTime := lastTime
+			for now := range time.Tick(interval) {
+				hashes := m.hashes.Load()
+				rate := float64(hashes-last) / now.Sub(lastTime).Seconds()
+				m.rate.Store(math.Float64bits(rate))
+				last, lastTime = hashes, now
+				if now.Sub(printTime) >= time.Minute {
+					printTime = now
+					fmt.Printf("hashrate: %.0f H/s\n", rate)
+				}
+			}
+		}()
+	})
+}
+
+// Hashrate is the number of hashes per second of all the workers.
+func Hashrate() float64 {
+	return math.Float64frombits(meter.rate.Load())
+}
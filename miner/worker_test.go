@@ -0,0 +1,46 @@
+package miner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/glossd/viatcoin/chain"
+)
+
+func testBlock(t *testing.T, bits uint32) chain.Block {
+	pk, err := chain.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := chain.NewTransactionS(pk.PublicKey().Address(chain.Mainnet), chain.OriginalMinerReward).Sign(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain.NewBlock(chain.GenesisBlock().Hash(), []chain.Transaction{cb}, bits)
+}
+
+func TestSolve(t *testing.T) {
+	// a quarter million hashes on average
+	b := testBlock(t, 0x1e400000)
+	for _, workers := range []int{1, 4} {
+		solved, ok := solve(context.Background(), b, workers)
+		if !ok || !solved.Valid() {
+			t.Errorf("workers=%d: expected a valid block", workers)
+		}
+	}
+}
+
+func TestSolveCancel(t *testing.T) {
+	// impossible to solve in the test's time
+	b := testBlock(t, 0x1b0404cb)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, ok := solve(ctx, b, 4); ok {
+		t.Fatal("expected no solution")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("workers didn't stop on cancel")
+	}
+}
@@ -0,0 +1,61 @@
+package pool
+
+import (
+	"math/big"
+
+	"github.com/glossd/viatcoin/chain"
+)
+
+// Contribution is the accepted work of a worker, the block rewards are split by it.
+type Contribution struct {
+	Shares uint64
+	// the sum of the expected hashes of the shares, see chain.Block.Work
+	Work *big.Int
+	// blocks found by the worker
+	Blocks int
+}
+
+func (p *Pool) credit(worker string, work *big.Int, block bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.contributions[worker]
+	if !ok {
+		c = &Contribution{Work: new(big.Int)}
+		p.contributions[worker] = c
+	}
+	c.Shares++
+	c.Work.Add(c.Work, work)
+	if block {
+		c.Blocks++
+	}
+}
+
+// Contributions returns the contribution of each worker.
+func (p *Pool) Contributions() map[string]Contribution {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make(map[string]Contribution, len(p.contributions))
+	for w, c := range p.contributions {
+		res[w] = Contribution{Shares: c.Shares, Work: new(big.Int).Set(c.Work), Blocks: c.Blocks}
+	}
+	return res
+}
+
+// Payouts splits the amount between the workers proportionally to their work.
+// The rounding leftover isn't assigned.
+func (p *Pool) Payouts(amount chain.Coin) map[string]chain.Coin {
+	contributions := p.Contributions()
+	total := new(big.Int)
+	for _, c := range contributions {
+		total.Add(total, c.Work)
+	}
+	res := make(map[string]chain.Coin, len(contributions))
+	if total.Sign() == 0 {
+		return res
+	}
+	for w, c := range contributions {
+		share := new(big.Int).Mul(new(big.Int).SetUint64(uint64(amount)), c.Work)
+		res[w] = chain.Coin(share.Div(share, total).Uint64())
+	}
+	return res
+}
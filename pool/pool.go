@@ -0,0 +1,447 @@
+// Package pool is a mining pool server speaking Stratum v1, so that many machines mine for one coinbase.
+// Jobs are built from the node's block template, see chain.BlockTemplate. Workers submit shares,
+// hashes meeting the pool's share target which is easier than the block's target,
+// and the work of the shares of each worker measures its hashpower for the payout, see Pool.Payouts.
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glossd/fetch"
+	"github.com/glossd/viatcoin/chain"
+)
+
+type Config struct {
+	Pk      *chain.PrivateKey // required, the coinbase pays its address
+	Network chain.Net         // defaults to Mainnet
+	ApiUrl  string
+	// the target of the shares, defaults to 0x1f00ffff. A block's target is used if it's easier.
+	ShareBits uint32
+	// how often the node is asked for a new template, defaults to 2 seconds
+	PollInterval time.Duration
+}
+
+type Pool struct {
+	cfg      Config
+	address  string
+	listener net.Listener
+	done     chan struct{}
+
+	nextExtranonce atomic.Uint32
+	nextJob        atomic.Uint64
+
+	mu       sync.Mutex
+	template chain.BlockTemplate
+	// signed once for the template, the miners only change its extra nonce
+	coinbase chain.Transaction
+	jobSeq   uint64
+	conns    map[*conn]bool
+	// worker name -> its work
+	contributions map[string]*Contribution
+}
+
+// Listen starts listening to miners at the address, Serve accepts them.
+func Listen(addr string, cfg Config) (*Pool, error) {
+	if cfg.Pk == nil {
+		return nil, fmt.Errorf("private key isn't specified")
+	}
+	if cfg.ApiUrl != "" {
+		fetch.SetBaseURL(cfg.ApiUrl + "/api")
+	}
+	if cfg.ShareBits == 0 {
+		cfg.ShareBits = 0x1f00ffff
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 2 * time.Second
+	}
+	p := &Pool{
+		cfg:           cfg,
+		address:       cfg.Pk.PublicKey().Address(cfg.Network),
+		done:          make(chan struct{}),
+		conns:         map[*conn]bool{},
+		contributions: map[string]*Contribution{},
+	}
+	if err := p.refresh(); err != nil {
+		return nil, fmt.Errorf("failed to get block template: %s", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p.listener = l
+	return p, nil
+}
+
+func (p *Pool) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Serve accepts miners until Close.
+func (p *Pool) Serve() error {
+	go p.pollTemplates()
+	for {
+		nc, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.done:
+				return nil
+			default:
+				return err
+			}
+		}
+		c := &conn{
+			pool:        p,
+			nc:          nc,
+			enc:         json.NewEncoder(nc),
+			extranonce1: binary.BigEndian.AppendUint32(nil, p.nextExtranonce.Add(1)),
+			workers:     map[string]bool{},
+			jobs:        map[string]*job{},
+		}
+		go c.serve()
+	}
+}
+
+func (p *Pool) Close() error {
+	close(p.done)
+	err := p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.nc.Close()
+	}
+	return err
+}
+
+func (p *Pool) pollTemplates() {
+	ticker := time.NewTicker(p.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		if err := p.refresh(); err != nil {
+			log.Printf("pool: failed to get block template: %s", err)
+		}
+	}
+}
+
+// refresh gets the template from the node and sends a new job to the miners if it changed.
+func (p *Pool) refresh() error {
+	t, err := fetch.Get[chain.BlockTemplate]("/mining/template")
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if t.ID == p.template.ID {
+		p.mu.Unlock()
+		return nil
+	}
+	coinbase, err := chain.NewTransactionS(p.address, t.Reward+t.Fees).Sign(p.cfg.Pk)
+	if err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("failed to sign coinbase: %s", err)
+	}
+	// the jobs of the old tip can't become blocks, miners should drop them
+	clean := !bytes.Equal(t.PreviousHash, p.template.PreviousHash)
+	p.template = t
+	p.coinbase = coinbase
+	p.jobSeq = p.nextJob.Add(1)
+	seq := p.jobSeq
+	conns := make([]*conn, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	// a slow miner mustn't hold up the others, each connection is written to outside the lock
+	for _, c := range conns {
+		c.notify(seq, t, coinbase, clean)
+	}
+	return nil
+}
+
+// shareTarget is the target of the shares of the block with the bits, it's never harder than the block's one.
+func (p *Pool) shareTarget(bits uint32) *big.Int {
+	share := chain.Block{DifficultyTargetBits: p.cfg.ShareBits}.DifficultyTarget()
+	if block := (chain.Block{DifficultyTargetBits: bits}).DifficultyTarget(); block.Cmp(share) > 0 {
+		return block
+	}
+	return share
+}
+
+// the coinbase's extra nonce is the height, extranonce1, unique for each connection, and extranonce2 chosen by the miner.
+const (
+	extranonce1Size = 4
+	extranonce2Size = 4
+)
+
+const (
+	// the node keeps as many templates of the tip, the older jobs are dropped with their shares
+	maxJobs = 16
+	// a miner not reading its socket is disconnected
+	writeTimeout = 10 * time.Second
+)
+
+// job is the block a connection works on, the miner chooses extranonce2, the timestamp and the nonce.
+type job struct {
+	id       string
+	seq      uint64
+	template chain.BlockTemplate
+	coinbase chain.Transaction
+	// header hashes of the submitted shares
+	shares map[string]bool
+}
+
+type conn struct {
+	pool        *Pool
+	nc          net.Conn
+	extranonce1 []byte
+
+	writeMu sync.Mutex
+	enc     *json.Encoder
+
+	mu         sync.Mutex
+	subscribed bool
+	difficulty float64
+	// authorized worker names
+	workers map[string]bool
+	jobs    map[string]*job
+	// the sequence number of the last job sent, the older ones arriving late are skipped
+	lastJob uint64
+}
+
+func (c *conn) serve() {
+	defer func() {
+		c.pool.mu.Lock()
+		delete(c.pool.conns, c)
+		c.pool.mu.Unlock()
+		c.nc.Close()
+	}()
+	scanner := bufio.NewScanner(c.nc)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			log.Printf("pool: malformed request, addr=%s: %s", c.nc.RemoteAddr(), err)
+			return
+		}
+		result, err := c.handle(req)
+		res := response{ID: req.ID, Result: result}
+		if err != nil {
+			res.Error = err
+		}
+		if err := c.write(res); err != nil {
+			return
+		}
+		if req.Method == "mining.subscribe" && err == nil {
+			c.pool.subscribe(c)
+		}
+	}
+}
+
+func (c *conn) write(v any) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.send(v)
+}
+
+// send writes the message, the caller holds writeMu.
+func (c *conn) send(v any) error {
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.enc.Encode(v)
+}
+
+func (c *conn) handle(req request) (any, *stratumError) {
+	switch req.Method {
+	case "mining.subscribe":
+		c.mu.Lock()
+		c.subscribed = true
+		c.mu.Unlock()
+		return []any{
+			[][]string{{"mining.set_difficulty", hex.EncodeToString(c.extranonce1)}, {"mining.notify", hex.EncodeToString(c.extranonce1)}},
+			hex.EncodeToString(c.extranonce1),
+			extranonce2Size,
+		}, nil
+	case "mining.authorize":
+		worker, err := stringParam(req.Params, 0)
+		if err != nil || worker == "" {
+			return false, newError(errOther, "worker name is required")
+		}
+		c.mu.Lock()
+		c.workers[worker] = true
+		c.mu.Unlock()
+		return true, nil
+	case "mining.submit":
+		if err := c.submit(req.Params); err != nil {
+			return false, err
+		}
+		return true, nil
+	default:
+		return nil, newError(errOther, "unknown method %q", req.Method)
+	}
+}
+
+// subscribe starts sending the jobs to the connection.
+func (p *Pool) subscribe(c *conn) {
+	p.mu.Lock()
+	p.conns[c] = true
+	seq, t, coinbase := p.jobSeq, p.template, p.coinbase
+	p.mu.Unlock()
+	c.notify(seq, t, coinbase, true)
+}
+
+// notify sends the job of the template to the miner, the connection is closed if it can't be written to.
+func (c *conn) notify(seq uint64, t chain.BlockTemplate, coinbase chain.Transaction, clean bool) {
+	id := strconv.FormatUint(seq, 16)
+	coinbase.ExtraNonce = chain.CoinbaseExtraNonce(t.Height, append(bytes.Clone(c.extranonce1), make([]byte, extranonce2Size)...))
+	j := &job{id: id, seq: seq, template: t, coinbase: coinbase, shares: map[string]bool{}}
+	b := t.NewBlock(coinbase)
+	difficulty, _ := new(big.Float).Quo(
+		new(big.Float).SetInt(chain.Block{DifficultyTargetBits: 0x1d00ffff}.DifficultyTarget()),
+		new(big.Float).SetInt(c.pool.shareTarget(t.Bits)),
+	).Float64()
+
+	encoded := coinbase.Encode()
+	branch := make([]string, len(t.CoinbaseBranch))
+	for i, h := range t.CoinbaseBranch {
+		branch[i] = hex.EncodeToString(h)
+	}
+
+	// the jobs are sent in the order of their registration
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	if seq <= c.lastJob {
+		c.mu.Unlock()
+		return
+	}
+	c.lastJob = seq
+	for oldID, old := range c.jobs {
+		if clean || old.seq+maxJobs <= seq {
+			delete(c.jobs, oldID)
+		}
+	}
+	c.jobs[id] = j
+	difficultyChanged := difficulty != c.difficulty
+	c.difficulty = difficulty
+	c.mu.Unlock()
+
+	if difficultyChanged {
+		if err := c.send(notification{Method: "mining.set_difficulty", Params: []any{difficulty}}); err != nil {
+			c.nc.Close()
+			return
+		}
+	}
+	err := c.send(notification{Method: "mining.notify", Params: []any{
+		id,
+		hex.EncodeToString(t.PreviousHash),
+		// the extra nonce is the last field of the coinbase, its length prefix already counts both extranonces
+		hex.EncodeToString(encoded[:len(encoded)-extranonce1Size-extranonce2Size]),
+		"",
+		branch,
+		hexUint32(b.Version),
+		hexUint32(t.Bits),
+		hexUint32(b.Timestamp),
+		clean,
+	}})
+	if err != nil {
+		c.nc.Close()
+	}
+}
+
+// submit checks the share [worker, job_id, extranonce2, ntime, nonce] and broadcasts the block if the share meets its target.
+func (c *conn) submit(params []any) *stratumError {
+	var fields [5]string
+	for i := range fields {
+		f, err := stringParam(params, i)
+		if err != nil {
+			return newError(errOther, "%s", err)
+		}
+		fields[i] = f
+	}
+	worker, jobID, extranonce2 := fields[0], fields[1], fields[2]
+
+	c.mu.Lock()
+	subscribed, authorized := c.subscribed, c.workers[worker]
+	j, ok := c.jobs[jobID]
+	c.mu.Unlock()
+	if !subscribed {
+		return newError(errNotSubscribed, "not subscribed")
+	}
+	if !authorized {
+		return newError(errUnauthorized, "unauthorized worker")
+	}
+	if !ok {
+		return newError(errJobNotFound, "job not found")
+	}
+	en2, err := hex.DecodeString(extranonce2)
+	if err != nil || len(en2) != extranonce2Size {
+		return newError(errOther, "extranonce2 must be %d bytes", extranonce2Size)
+	}
+	ntime, err := parseHexUint32(fields[3])
+	if err != nil {
+		return newError(errOther, "invalid ntime: %s", err)
+	}
+	nonce, err := parseHexUint32(fields[4])
+	if err != nil {
+		return newError(errOther, "invalid nonce: %s", err)
+	}
+	// the node rejects blocks further in the future than 2 hours
+	if ntime < j.template.MinTimestamp || int64(ntime) > time.Now().Add(2*time.Hour).Unix() {
+		return newError(errOther, "ntime out of range")
+	}
+
+	coinbase := j.coinbase
+	coinbase.ExtraNonce = chain.CoinbaseExtraNonce(j.template.Height, append(bytes.Clone(c.extranonce1), en2...))
+	b := j.template.NewBlock(coinbase)
+	b.Timestamp = ntime
+	b.Nonce = nonce
+	target := c.pool.shareTarget(b.DifficultyTargetBits)
+	if new(big.Int).SetBytes(b.Hash()).Cmp(target) > 0 {
+		return newError(errLowDifficulty, "low difficulty share")
+	}
+	hash := b.HashString()
+	c.mu.Lock()
+	duplicate := j.shares[hash]
+	j.shares[hash] = true
+	c.mu.Unlock()
+	if duplicate {
+		return newError(errDuplicateShare, "duplicate share")
+	}
+
+	found := false
+	if b.Valid() {
+		_, err := fetch.Post[string]("/mining/submit", chain.BlockSubmission{TemplateID: j.template.ID, Block: b})
+		if err != nil {
+			log.Printf("pool: block rejected, hash=%s, worker=%s: %s", hash, worker, err)
+		} else {
+			found = true
+			log.Printf("pool: block found, hash=%s, worker=%s", hash, worker)
+			go func() {
+				if err := c.pool.refresh(); err != nil {
+					log.Printf("pool: failed to get block template: %s", err)
+				}
+			}()
+		}
+	}
+	c.pool.credit(worker, work(target), found)
+	return nil
+}
+
+// work is the expected number of hashes to meet the target, like chain.Block.Work.
+func work(target *big.Int) *big.Int {
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), target)
+}
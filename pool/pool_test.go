@@ -0,0 +1,298 @@
+package pool
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glossd/fetch"
+	"github.com/glossd/viatcoin/chain"
+)
+
+// startPool serves the API of an in-memory Regtest node and a pool mining on it.
+func startPool(t *testing.T, shareBits uint32) *Pool {
+	chain.SetNetwork(chain.Regtest)
+	s := httptest.NewServer(chain.APIHandler())
+	fetch.SetBaseURL(s.URL + "/api")
+	pk, err := chain.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Listen("127.0.0.1:0", Config{Pk: pk, Network: chain.Regtest, ShareBits: shareBits, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve()
+	t.Cleanup(func() {
+		p.Close()
+		s.Close()
+		fetch.SetBaseURL("")
+		chain.SetNetwork(chain.Mainnet)
+	})
+	return p
+}
+
+type message struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// stratumMiner is the client side of Stratum, it builds the headers like a mining rig does.
+type stratumMiner struct {
+	t      *testing.T
+	conn   net.Conn
+	lines  *bufio.Scanner
+	nextID int
+	// the last mining.notify params
+	job         []json.RawMessage
+	extranonce1 string
+	extranonce2 string
+}
+
+func dial(t *testing.T, p *Pool) *stratumMiner {
+	c, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &stratumMiner{t: t, conn: c, lines: bufio.NewScanner(c), extranonce2: "00000000"}
+}
+
+func (m *stratumMiner) subscribe() {
+	res := m.call("mining.subscribe")
+	var result []json.RawMessage
+	if err := json.Unmarshal(res.Result, &result); err != nil || len(result) != 3 {
+		m.t.Fatalf("unexpected subscribe result: %s, %s", res.Result, res.Error)
+	}
+	if err := json.Unmarshal(result[1], &m.extranonce1); err != nil {
+		m.t.Fatal(err)
+	}
+	if string(result[2]) != "4" {
+		m.t.Fatalf("unexpected extranonce2 size: %s", result[2])
+	}
+}
+
+// call sends the request and returns its response, the notifications on the way are recorded.
+func (m *stratumMiner) call(method string, params ...any) message {
+	m.nextID++
+	req, _ := json.Marshal(map[string]any{"id": m.nextID, "method": method, "params": params})
+	if _, err := m.conn.Write(append(req, '\n')); err != nil {
+		m.t.Fatal(err)
+	}
+	for {
+		msg := m.read()
+		if msg.ID != nil && *msg.ID == m.nextID {
+			return msg
+		}
+	}
+}
+
+func (m *stratumMiner) read() message {
+	m.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if !m.lines.Scan() {
+		m.t.Fatalf("connection closed: %v", m.lines.Err())
+	}
+	var msg message
+	if err := json.Unmarshal(m.lines.Bytes(), &msg); err != nil {
+		m.t.Fatal(err)
+	}
+	if msg.Method == "mining.notify" {
+		m.job = nil
+		if err := json.Unmarshal(msg.Params, &m.job); err != nil {
+			m.t.Fatal(err)
+		}
+	}
+	return msg
+}
+
+// waitJob reads the notifications until a job other than the previous one arrives.
+func (m *stratumMiner) waitJob(previous string) {
+	for m.job == nil || m.jobField(0) == previous {
+		m.read()
+	}
+}
+
+func (m *stratumMiner) jobField(i int) string {
+	var s string
+	if err := json.Unmarshal(m.job[i], &s); err != nil {
+		m.t.Fatal(err)
+	}
+	return s
+}
+
+func (m *stratumMiner) header(nonce uint32) []byte {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		return b
+	}
+	var branch []string
+	if err := json.Unmarshal(m.job[4], &branch); err != nil {
+		m.t.Fatal(err)
+	}
+	coinbase := unhex(m.jobField(2) + m.extranonce1 + m.extranonce2 + m.jobField(3))
+	root := doubleSHA256(coinbase)
+	for _, h := range branch {
+		root = doubleSHA256(append(root, unhex(h)...))
+	}
+	le := func(s string) []byte {
+		return binary.LittleEndian.AppendUint32(nil, binary.BigEndian.Uint32(unhex(s)))
+	}
+	var h []byte
+	h = append(h, le(m.jobField(5))...)
+	h = append(h, unhex(m.jobField(1))...)
+	h = append(h, root...)
+	h = append(h, le(m.jobField(7))...)
+	h = append(h, le(m.jobField(6))...)
+	return binary.LittleEndian.AppendUint32(h, nonce)
+}
+
+// findNonce returns the first nonce whose header hash is in (above, upTo].
+func (m *stratumMiner) findNonce(above, upTo *big.Int) string {
+	for n := uint32(0); ; n++ {
+		h := new(big.Int).SetBytes(doubleSHA256(m.header(n)))
+		if h.Cmp(above) > 0 && h.Cmp(upTo) <= 0 {
+			return hexUint32(n)
+		}
+	}
+}
+
+func (m *stratumMiner) submit(worker, nonce string) message {
+	return m.call("mining.submit", worker, m.jobField(0), m.extranonce2, m.jobField(7), nonce)
+}
+
+func doubleSHA256(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+func errorCode(msg message) int {
+	var e []any
+	if err := json.Unmarshal(msg.Error, &e); err != nil || len(e) == 0 {
+		return 0
+	}
+	return int(e[0].(float64))
+}
+
+func TestStratumShares(t *testing.T) {
+	// regtest blocks need the first byte of the hash to be at most 0x05, the shares at most 0x07
+	p := startPool(t, 0x2007ffff)
+	blockTarget := chain.GenesisBlock().DifficultyTarget()
+	shareTarget := chain.Block{DifficultyTargetBits: 0x2007ffff}.DifficultyTarget()
+	maxHash := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	m := dial(t, p)
+	if res := m.call("mining.submit", "alice", "1", "", "00000000", "00000000"); errorCode(res) != errNotSubscribed {
+		t.Errorf("expected not subscribed error: %s", res.Error)
+	}
+	m.subscribe()
+	m.waitJob("")
+	if res := m.submit("alice", "00000000"); errorCode(res) != errUnauthorized {
+		t.Errorf("expected unauthorized error: %s", res.Error)
+	}
+	m.call("mining.authorize", "alice", "x")
+	m.call("mining.authorize", "bob", "x")
+
+	low := m.findNonce(shareTarget, maxHash)
+	if res := m.submit("alice", low); errorCode(res) != errLowDifficulty {
+		t.Errorf("expected low difficulty error: %s", res.Error)
+	}
+	share := m.findNonce(blockTarget, shareTarget)
+	if res := m.submit("alice", share); string(res.Result) != "true" {
+		t.Fatalf("share rejected: %s", res.Error)
+	}
+	if res := m.submit("alice", share); errorCode(res) != errDuplicateShare {
+		t.Errorf("expected duplicate share error: %s", res.Error)
+	}
+	// another extranonce2 is another header
+	m.extranonce2 = "00000001"
+	if res := m.submit("alice", m.findNonce(blockTarget, shareTarget)); string(res.Result) != "true" {
+		t.Fatalf("share of another extranonce2 rejected: %s", res.Error)
+	}
+	if chain.GetLastBlock().HashString() != chain.GenesisBlock().HashString() {
+		t.Fatal("a share mustn't become a block")
+	}
+
+	oldJob := m.jobField(0)
+	block := m.findNonce(big.NewInt(-1), blockTarget)
+	if res := m.submit("bob", block); string(res.Result) != "true" {
+		t.Fatalf("block share rejected: %s", res.Error)
+	}
+	tip := chain.GetLastBlock()
+	if tip.HashString() == chain.GenesisBlock().HashString() {
+		t.Fatal("the block wasn't submitted to the node")
+	}
+	if cb := tip.Transactions[0]; cb.Transfers[0].To != p.address || !strings.HasSuffix(hex.EncodeToString(cb.ExtraNonce), m.extranonce1+m.extranonce2) {
+		t.Error("the coinbase must pay the pool and have the miner's extra nonce")
+	}
+
+	other := dial(t, p)
+	other.subscribe()
+	if other.extranonce1 == m.extranonce1 {
+		t.Error("each connection must get its own extranonce1")
+	}
+
+	m.waitJob(oldJob)
+	if res := m.call("mining.submit", "alice", oldJob, m.extranonce2, m.jobField(7), share); errorCode(res) != errJobNotFound {
+		t.Errorf("job of the old tip must be dropped: %s", res.Error)
+	}
+
+	c := p.Contributions()
+	if c["alice"].Shares != 2 || c["alice"].Blocks != 0 || c["bob"].Shares != 1 || c["bob"].Blocks != 1 {
+		t.Fatalf("unexpected contributions: %+v", c)
+	}
+	payouts := p.Payouts(100)
+	if payouts["alice"] != 66 || payouts["bob"] != 33 {
+		t.Errorf("payouts must be proportional to the work: %v", payouts)
+	}
+}
+
+func TestJobsCapped(t *testing.T) {
+	p := startPool(t, 0x2007ffff)
+	m := dial(t, p)
+	m.subscribe()
+	m.waitJob("")
+
+	p.mu.Lock()
+	var c *conn
+	for pc := range p.conns {
+		c = pc
+	}
+	seq, tmpl, coinbase := p.jobSeq, p.template, p.coinbase
+	p.mu.Unlock()
+
+	for i := 1; i <= maxJobs+5; i++ {
+		c.notify(seq+uint64(i), tmpl, coinbase, false)
+		m.waitJob(m.jobField(0))
+	}
+	last := m.jobField(0)
+	// a job arriving after a newer one is skipped
+	c.notify(seq+1, tmpl, coinbase, false)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.jobs) != maxJobs {
+		t.Errorf("expected %d jobs, got %d", maxJobs, len(c.jobs))
+	}
+	if c.jobs[strconv.FormatUint(seq, 16)] != nil {
+		t.Error("the superseded job must be dropped")
+	}
+	if c.jobs[last] == nil {
+		t.Error("the last job must be kept")
+	}
+}
@@ -0,0 +1,83 @@
+package pool
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Stratum v1 is newline-delimited JSON-RPC over TCP.
+// The miner calls mining.subscribe, mining.authorize and mining.submit,
+// the pool pushes mining.set_difficulty and mining.notify.
+
+type request struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params []any           `json:"params"`
+}
+
+type response struct {
+	ID     json.RawMessage `json:"id"`
+	Result any             `json:"result"`
+	Error  *stratumError   `json:"error"`
+}
+
+type notification struct {
+	ID     any    `json:"id"` // always null
+	Method string `json:"method"`
+	Params []any  `json:"params"`
+}
+
+// the error codes miners know
+const (
+	errOther          = 20
+	errJobNotFound    = 21
+	errDuplicateShare = 22
+	errLowDifficulty  = 23
+	errUnauthorized   = 24
+	errNotSubscribed  = 25
+)
+
+type stratumError struct {
+	Code int
+	Msg  string
+}
+
+// MarshalJSON encodes the error as [code, message, traceback].
+func (e *stratumError) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Code, e.Msg, nil})
+}
+
+func (e *stratumError) Error() string {
+	return fmt.Sprintf("stratum error %d: %s", e.Code, e.Msg)
+}
+
+func newError(code int, format string, a ...any) *stratumError {
+	return &stratumError{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+// stringParam returns the i-th parameter, which must be a string.
+func stringParam(params []any, i int) (string, error) {
+	if i >= len(params) {
+		return "", fmt.Errorf("missing parameter %d", i)
+	}
+	s, ok := params[i].(string)
+	if !ok {
+		return "", fmt.Errorf("parameter %d must be a string", i)
+	}
+	return s, nil
+}
+
+// Stratum sends the 32-bit fields of the header as big-endian hex.
+func hexUint32(v uint32) string {
+	return hex.EncodeToString(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func parseHexUint32(s string) (uint32, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, fmt.Errorf("expected 8 hex digits, got=%q", s)
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
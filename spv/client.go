@@ -0,0 +1,308 @@
+// Package spv is a light client, it follows the chain by headers only and
+// checks transactions of the watched addresses with merkle proofs (Simplified Payment Verification).
+// The client trusts the nodes only to serve the data, everything is verified:
+// the proof-of-work and the difficulty of each header, the chain with the most work and the merkle branches.
+// chain.SetNetwork must be called before creating a client.
+package spv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/glossd/fetch"
+	"github.com/glossd/viatcoin/chain"
+)
+
+type Client struct {
+	apiUrls []string
+
+	mu sync.Mutex
+	// the chain with the most work, genesis first, without transactions
+	headers []chain.Block
+	// block hash -> height in headers
+	heights map[string]int
+	watched map[string]bool
+	// txid -> verified transaction
+	txs map[string]trackedTx
+}
+
+type trackedTx struct {
+	tx        chain.Transaction
+	blockHash string
+	// the first transaction of a block mints coins, nothing is withdrawn from its sender.
+	coinbase bool
+}
+
+// NewClient creates a client which syncs from the nodes' APIs.
+func NewClient(apiUrls ...string) *Client {
+	genesis := chain.GenesisBlock()
+	genesis.Transactions = nil
+	c := &Client{
+		headers: []chain.Block{genesis},
+		heights: map[string]int{genesis.HashString(): 0},
+		watched: map[string]bool{},
+		txs:     map[string]trackedTx{},
+	}
+	for _, u := range apiUrls {
+		if !strings.Contains(u, "://") {
+			u = "http://" + u
+		}
+		c.apiUrls = append(c.apiUrls, strings.TrimSuffix(u, "/"))
+	}
+	return c
+}
+
+// Watch makes the client accept transactions of the address in Track.
+func (c *Client) Watch(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watched[address] = true
+}
+
+// Height of the best header chain.
+func (c *Client) Height() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.headers) - 1
+}
+
+// Tip is the last header of the best chain.
+func (c *Client) Tip() chain.Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.headers[len(c.headers)-1]
+}
+
+// Sync downloads the new headers from every node and switches to the chain with the most work.
+func (c *Client) Sync() error {
+	var errs []error
+	for _, u := range c.apiUrls {
+		if err := c.syncFrom(u); err != nil {
+			errs = append(errs, fmt.Errorf("sync from %s: %s", u, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Client) syncFrom(apiUrl string) error {
+	for {
+		c.mu.Lock()
+		// appending to the chain doesn't change the snapshot, a reorg copies it, see apply
+		headers := c.headers[:len(c.headers):len(c.headers)]
+		c.mu.Unlock()
+
+		forkHeight, branch, err := download(apiUrl, headers)
+		if err != nil || len(branch) == 0 {
+			return err
+		}
+		if work(branch).Cmp(work(headers[forkHeight+1:])) <= 0 {
+			return nil
+		}
+		if c.apply(headers, forkHeight, branch) {
+			return nil
+		}
+		// another sync changed the chain while downloading, the headers are verified again against it
+	}
+}
+
+// download gets and verifies the headers of the node's chain after the fork with ours.
+func download(apiUrl string, headers []chain.Block) (int, []chain.Block, error) {
+	locator := locator(headers)
+	forkHeight := -1
+	var branch []chain.Block
+	for {
+		raw, err := fetch.Get[[][]byte](fmt.Sprintf("%s/api/headers?limit=%d&locator=%s", apiUrl, chain.MaxHeadersPerRequest, strings.Join(locator, ",")))
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, r := range raw {
+			h, err := chain.ParseBlockHeader(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			if forkHeight == -1 {
+				forkHeight = indexOf(headers, h.PreviousHash)
+				if forkHeight == -1 {
+					return 0, nil, fmt.Errorf("headers don't connect to our chain, hash=%s", h.HashString())
+				}
+			} else if !bytes.Equal(h.PreviousHash, branch[len(branch)-1].Hash()) {
+				return 0, nil, fmt.Errorf("PreviousHash is wrong, hash=%s", h.HashString())
+			}
+			blockAt := func(height int) chain.Block {
+				if height <= forkHeight {
+					return headers[height]
+				}
+				return branch[height-forkHeight-1]
+			}
+			if err := chain.VerifyHeader(h, forkHeight+1+len(branch), blockAt); err != nil {
+				return 0, nil, err
+			}
+			branch = append(branch, h)
+		}
+		if len(raw) < chain.MaxHeadersPerRequest {
+			break
+		}
+		locator = []string{branch[len(branch)-1].HashString()}
+	}
+	return forkHeight, branch, nil
+}
+
+// indexOf returns the height of the header with the hash, the forks are usually near the tip.
+func indexOf(headers []chain.Block, hash []byte) int {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if bytes.Equal(headers[i].Hash(), hash) {
+			return i
+		}
+	}
+	return -1
+}
+
+// apply switches to the branch if the chain is still the downloaded against one.
+func (c *Client) apply(snapshot []chain.Block, forkHeight int, branch []chain.Block) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.headers) != len(snapshot) || c.headers[len(c.headers)-1].HashString() != snapshot[len(snapshot)-1].HashString() {
+		return false
+	}
+	for _, h := range c.headers[forkHeight+1:] {
+		delete(c.heights, h.HashString())
+	}
+	kept := c.headers[:forkHeight+1]
+	if forkHeight+1 < len(c.headers) {
+		// the snapshots of the other syncs still read the replaced headers
+		kept = slices.Clip(kept)
+	}
+	c.headers = append(kept, branch...)
+	for i, h := range branch {
+		c.heights[h.HashString()] = forkHeight + 1 + i
+	}
+	return true
+}
+
+// locator lists hashes of the header chain from the tip back to the genesis, see chain's blockLocator.
+func locator(headers []chain.Block) []string {
+	var locator []string
+	step := 1
+	for i := len(headers) - 1; i > 0; i -= step {
+		locator = append(locator, headers[i].HashString())
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, headers[0].HashString())
+}
+
+func work(headers []chain.Block) *big.Int {
+	acc := new(big.Int)
+	for _, h := range headers {
+		acc.Add(acc, h.Work())
+	}
+	return acc
+}
+
+// Track verifies that the transaction of a watched address is in the best header chain.
+// The transaction comes from the wallet, e.g. the payer sends it, the nodes serve only its merkle proof.
+func (c *Client) Track(tx chain.Transaction) error {
+	if !c.involvesWatched(tx) {
+		return fmt.Errorf("transaction doesn't touch a watched address")
+	}
+	id := tx.ID()
+	var errs []error
+	for _, u := range c.apiUrls {
+		proof, err := fetch.Get[chain.MerkleProof](u + "/api/tx/" + id + "/proof")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := c.accept(tx, proof); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to verify transaction tx_id=%s: %s", id, errors.Join(errs...))
+}
+
+func (c *Client) involvesWatched(tx chain.Transaction) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watched[tx.From] {
+		return true
+	}
+	for _, tf := range tx.Transfers {
+		if c.watched[tf.To] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) accept(tx chain.Transaction, proof chain.MerkleProof) error {
+	header, err := chain.ParseBlockHeader(proof.Header)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	height, ok := c.heights[header.HashString()]
+	if !ok {
+		return fmt.Errorf("block isn't in the best header chain, hash=%s", header.HashString())
+	}
+	if height != proof.Height {
+		return fmt.Errorf("block height mismatch, expected=%d, got=%d", height, proof.Height)
+	}
+	if !proof.Verify(tx.ID()) {
+		return fmt.Errorf("invalid merkle proof")
+	}
+	c.txs[tx.ID()] = trackedTx{tx: tx, blockHash: header.HashString(), coinbase: proof.Index == 0}
+	return nil
+}
+
+// Confirmations returns how many blocks are on top of the tracked transaction's block, including it.
+// It's zero if the transaction isn't tracked or its block was reorganized out of the best chain.
+func (c *Client) Confirmations(txID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.txs[txID]
+	if !ok {
+		return 0
+	}
+	height, ok := c.heights[t.blockHash]
+	if !ok {
+		return 0
+	}
+	return len(c.headers) - height
+}
+
+// Balance sums the tracked transactions of the address in the best chain.
+// It's the real balance only if every transaction of the address is tracked.
+func (c *Client) Balance(address string) chain.Coin {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var received, sent chain.Coin
+	for _, t := range c.txs {
+		if _, ok := c.heights[t.blockHash]; !ok {
+			continue
+		}
+		for _, tf := range t.tx.Transfers {
+			if tf.To == address {
+				received += tf.Amount
+			}
+			if t.tx.From == address && !t.coinbase {
+				sent += tf.Amount
+			}
+		}
+		if t.tx.From == address && !t.coinbase {
+			sent += t.tx.Fee
+		}
+	}
+	if sent > received {
+		return 0
+	}
+	return received - sent
+}
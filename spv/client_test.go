@@ -0,0 +1,195 @@
+package spv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/glossd/viatcoin/chain"
+)
+
+func setupRegtest(t *testing.T) {
+	chain.SetNetwork(chain.Regtest)
+	t.Cleanup(func() { chain.SetNetwork(chain.Mainnet) })
+}
+
+func mustKey(t *testing.T) *chain.PrivateKey {
+	k, err := chain.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// heights of the mined blocks, genesis isn't there
+var heights = map[string]int{}
+
+func mine(t *testing.T, prev chain.Block, miner *chain.PrivateKey, txs ...chain.Transaction) chain.Block {
+	cb, err := chain.NewTransactionS(miner.PublicKey().Address(chain.Regtest), chain.GetMinerReward()).Sign(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	height := heights[prev.HashString()] + 1
+	cb.ExtraNonce = chain.CoinbaseExtraNonce(height, nil)
+	b := chain.NewBlock(prev.Hash(), append([]chain.Transaction{cb}, txs...), chain.GenesisBlock().DifficultyTargetBits)
+	b.Timestamp = prev.Timestamp + 1
+	for !b.Valid() {
+		b.Nonce++
+	}
+	heights[b.HashString()] = height
+	return b
+}
+
+// headersServer serves only GET /api/headers of the blocks, genesis first.
+func headersServer(blocks []chain.Block) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/headers" {
+			http.NotFound(w, r)
+			return
+		}
+		start := 1
+	search:
+		for _, h := range strings.Split(r.URL.Query().Get("locator"), ",") {
+			for i, b := range blocks {
+				if b.HashString() == h {
+					start = i + 1
+					break search
+				}
+			}
+		}
+		var res [][]byte
+		for _, b := range blocks[min(start, len(blocks)):] {
+			res = append(res, b.Header())
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+}
+
+func TestClient(t *testing.T) {
+	setupRegtest(t)
+	alice, bob, miner := mustKey(t), mustKey(t), mustKey(t)
+	bobAddr := bob.PublicKey().Address(chain.Regtest)
+
+	genesis := chain.GenesisBlock()
+	a1 := mine(t, genesis, alice)
+	if err := chain.Broadcast(a1); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := chain.NewTransactionS(bobAddr, 10).Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2 := mine(t, a1, miner, tx)
+	if err := chain.Broadcast(a2); err != nil {
+		t.Fatal(err)
+	}
+	node := httptest.NewServer(chain.APIHandler())
+	defer node.Close()
+
+	c := NewClient(node.URL)
+	c.Watch(bobAddr)
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Height() != 2 || !c.Tip().Equals(a2) {
+		t.Fatalf("expected to sync to a2, height=%d", c.Height())
+	}
+	if err := c.Track(a1.Transactions[0]); err == nil {
+		t.Error("transaction of an unwatched address must be rejected")
+	}
+	if err := c.Track(tx); err != nil {
+		t.Fatal(err)
+	}
+	if c.Confirmations(tx.ID()) != 1 || c.Balance(bobAddr) != 10 {
+		t.Errorf("unexpected state, confirmations=%d, balance=%d", c.Confirmations(tx.ID()), c.Balance(bobAddr))
+	}
+	unmined, err := chain.NewTransactionS(bobAddr, 20).Sign(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Track(unmined); err == nil {
+		t.Error("transaction which isn't in the chain must be rejected")
+	}
+
+	// another node has more work on a branch without the payment
+	b1 := mine(t, genesis, miner)
+	b2 := mine(t, b1, miner)
+	b3 := mine(t, b2, miner)
+	fork := headersServer([]chain.Block{genesis, b1, b2, b3})
+	defer fork.Close()
+	c.apiUrls = append(c.apiUrls, fork.URL)
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Height() != 3 || !c.Tip().Equals(b3) {
+		t.Fatalf("expected to switch to the branch with more work, height=%d", c.Height())
+	}
+	if c.Confirmations(tx.ID()) != 0 || c.Balance(bobAddr) != 0 {
+		t.Error("transaction of the abandoned branch must not count")
+	}
+}
+
+func TestClientRejectsInvalidHeaders(t *testing.T) {
+	setupRegtest(t)
+	miner := mustKey(t)
+	genesis := chain.GenesisBlock()
+	b1 := mine(t, genesis, miner)
+	bad := mine(t, b1, miner)
+	bad.DifficultyTargetBits = 0x207fffff
+	for !bad.Valid() {
+		bad.Nonce++
+	}
+	s := headersServer([]chain.Block{genesis, b1, bad})
+	defer s.Close()
+
+	c := NewClient(s.URL)
+	if err := c.Sync(); err == nil {
+		t.Error("header with unexpected difficulty bits must be rejected")
+	}
+	if c.Height() != 0 {
+		t.Errorf("nothing must be applied from an invalid chain, height=%d", c.Height())
+	}
+}
+
+func TestSyncDoesntHoldLockDownloading(t *testing.T) {
+	setupRegtest(t)
+	miner := mustKey(t)
+	genesis := chain.GenesisBlock()
+	a1 := mine(t, genesis, miner)
+	b1 := mine(t, genesis, miner)
+	b2 := mine(t, b1, miner)
+
+	slow := headersServer([]chain.Block{genesis, a1})
+	defer slow.Close()
+	requested, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	gate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			close(requested)
+			<-release
+		})
+		http.Redirect(w, r, slow.URL+r.URL.String(), http.StatusTemporaryRedirect)
+	}))
+	defer gate.Close()
+	fast := headersServer([]chain.Block{genesis, b1, b2})
+	defer fast.Close()
+
+	c := NewClient(gate.URL, fast.URL)
+	done := make(chan error)
+	go func() { done <- c.syncFrom(c.apiUrls[0]) }()
+	<-requested
+	if err := c.syncFrom(c.apiUrls[1]); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	// the slow node's headers were downloaded against genesis, they're verified again against b2
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if c.Height() != 2 || !c.Tip().Equals(b2) {
+		t.Fatalf("expected to stay on the chain with more work, height=%d", c.Height())
+	}
+}